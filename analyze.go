@@ -0,0 +1,130 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/blevesearch/bleve/v2/analysis"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+var tokenTypeNames = []string{
+	analysis.AlphaNumeric: "alphanumeric",
+	analysis.Ideographic:  "ideographic",
+	analysis.Numeric:      "numeric",
+	analysis.DateTime:     "datetime",
+	analysis.Shingle:      "shingle",
+	analysis.Single:       "single",
+	analysis.Double:       "double",
+	analysis.Boolean:      "boolean",
+}
+
+// analyzeRequest is the body of an analyze request: the text, and either
+// the name of an analyzer or a field whose analyzer to use.
+type analyzeRequest struct {
+	Text     string `json:"text"`
+	Analyzer string `json:"analyzer"`
+	Field    string `json:"field"`
+}
+
+type analyzeToken struct {
+	Term     string `json:"term"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Position int    `json:"position"`
+	Type     string `json:"type"`
+	KeyWord  bool   `json:"keyword,omitempty"`
+}
+
+// analyzeHandler shows how an analyzer of the index mapping tokenizes
+// some text, which is what is indexed for it, or searched for by match
+// queries.
+type analyzeHandler struct {
+	defaultIndexName string
+}
+
+func newAnalyzeHandler(defaultIndexName string) *analyzeHandler {
+	return &analyzeHandler{
+		defaultIndexName: defaultIndexName,
+	}
+}
+
+func (h *analyzeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	index := bleveHttp.IndexByName(h.defaultIndexName)
+	if index == nil {
+		showError(w, req, fmt.Sprintf("no such index '%s'", h.defaultIndexName), 404)
+		return
+	}
+	m := index.Mapping()
+	if m == nil {
+		showError(w, req, "index has no mapping", 500)
+		return
+	}
+
+	requestBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error reading request body: %v", err), 400)
+		return
+	}
+	var analyzeRequest analyzeRequest
+	err = json.Unmarshal(requestBody, &analyzeRequest)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error parsing request: %v", err), 400)
+		return
+	}
+
+	analyzerName := analyzeRequest.Analyzer
+	switch {
+	case analyzerName != "" && analyzeRequest.Field != "":
+		showError(w, req, "give an analyzer or a field, not both", 400)
+		return
+	case analyzeRequest.Field != "":
+		analyzerName = m.AnalyzerNameForPath(analyzeRequest.Field)
+	case analyzerName == "":
+		showError(w, req, "an analyzer or a field is required", 400)
+		return
+	}
+	analyzer := m.AnalyzerNamed(analyzerName)
+	if analyzer == nil {
+		showError(w, req, fmt.Sprintf("no such analyzer '%s'", analyzerName), 400)
+		return
+	}
+
+	tokens := []analyzeToken{}
+	for _, token := range analyzer.Analyze([]byte(analyzeRequest.Text)) {
+		typeName := fmt.Sprintf("%d", token.Type)
+		if int(token.Type) < len(tokenTypeNames) {
+			typeName = tokenTypeNames[token.Type]
+		}
+		tokens = append(tokens, analyzeToken{
+			Term:     string(token.Term),
+			Start:    token.Start,
+			End:      token.End,
+			Position: token.Position,
+			Type:     typeName,
+			KeyWord:  token.KeyWord,
+		})
+	}
+
+	rv := struct {
+		Analyzer string         `json:"analyzer"`
+		Field    string         `json:"field,omitempty"`
+		Tokens   []analyzeToken `json:"tokens"`
+	}{
+		Analyzer: analyzerName,
+		Field:    analyzeRequest.Field,
+		Tokens:   tokens,
+	}
+	mustEncode(w, rv)
+}
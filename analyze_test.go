@@ -0,0 +1,100 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+func TestAnalyzeHandler(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	bleveHttp.RegisterIndexName("beer-analyze-test", index)
+	defer bleveHttp.UnregisterIndexByName("beer-analyze-test")
+	handler := newAnalyzeHandler("beer-analyze-test")
+
+	tests := []struct {
+		body     string
+		status   int
+		analyzer string
+		tokens   []analyzeToken
+	}{
+		{
+			body:     `{"text": "The Brewing Ales", "field": "description"}`,
+			status:   200,
+			analyzer: "en",
+			tokens: []analyzeToken{
+				{Term: "brew", Start: 4, End: 11, Position: 2, Type: "alphanumeric"},
+				// which is why a term search for "ale" misses
+				{Term: "al", Start: 12, End: 16, Position: 3, Type: "alphanumeric"},
+			},
+		},
+		{
+			body:     `{"text": "Imperial Stout", "field": "style"}`,
+			status:   200,
+			analyzer: "keyword",
+			tokens: []analyzeToken{
+				{Term: "Imperial Stout", Start: 0, End: 14, Position: 1, Type: "alphanumeric"},
+			},
+		},
+		{
+			body:     `{"text": "Imperial Stout", "analyzer": "standard"}`,
+			status:   200,
+			analyzer: "standard",
+			tokens: []analyzeToken{
+				{Term: "imperial", Start: 0, End: 8, Position: 1, Type: "alphanumeric"},
+				{Term: "stout", Start: 9, End: 14, Position: 2, Type: "alphanumeric"},
+			},
+		},
+		{body: `{"text": "x", "analyzer": "no-such-analyzer"}`, status: 400},
+		{body: `{"text": "x", "analyzer": "en", "field": "name"}`, status: 400},
+		{body: `{"text": "x"}`, status: 400},
+		{body: `not json`, status: 400},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/analyze", strings.NewReader(test.body)))
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.body, test.status, rec.Code, rec.Body)
+			continue
+		}
+		if rec.Code != 200 {
+			continue
+		}
+		var result struct {
+			Analyzer string         `json:"analyzer"`
+			Tokens   []analyzeToken `json:"tokens"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Analyzer != test.analyzer {
+			t.Errorf("%s: expected analyzer %s, got %s", test.body, test.analyzer, result.Analyzer)
+		}
+		if !reflect.DeepEqual(result.Tokens, test.tokens) {
+			t.Errorf("%s: expected tokens %+v, got %+v", test.body, test.tokens, result.Tokens)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	keysFile          = flag.String("keys", "", "API keys file; if empty, write and admin endpoints are refused")
+	insecureOpenAdmin = flag.Bool("insecureOpenAdmin", false, "without -keys, open write and admin endpoints to anyone")
+	auditLogPath      = flag.String("auditLog", "", "file to append the audit log of writes to (default stderr)")
+)
+
+// role is what an API key is allowed to do. Each role includes the ones
+// before it.
+type role int
+
+const (
+	roleRead role = iota
+	roleWrite
+	roleAdmin
+)
+
+var roleNames = []string{"read", "write", "admin"}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func (r *role) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for i, roleName := range roleNames {
+		if roleName == name {
+			*r = role(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role '%s'", name)
+}
+
+// apiKey is one entry of the keys file. The ID identifies the key in
+// the audit log, so the key itself is never written out.
+type apiKey struct {
+	ID   string `json:"id"`
+	Key  string `json:"key"`
+	Role role   `json:"role"`
+}
+
+// apiKeys checks the API key sent with a request against the keys file
+// and records writes in the audit log. A nil *apiKeys, as the server
+// runs without a keys file, only lets read requests through.
+type apiKeys struct {
+	keys []apiKey
+	// open lets everything through, for -insecureOpenAdmin
+	open bool
+
+	auditMutex sync.Mutex
+	audit      io.Writer
+}
+
+// loadAPIKeys reads a keys file of the form
+//
+//	{"keys": [{"id": "ci", "key": "...", "role": "write"}]}
+func loadAPIKeys(path string, audit io.Writer) (*apiKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Keys []apiKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	ids := map[string]bool{}
+	for _, key := range file.Keys {
+		if key.ID == "" || key.Key == "" {
+			return nil, fmt.Errorf("error in %s: every key needs an id and a key", path)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("error in %s: duplicate key id '%s'", path, key.ID)
+		}
+		ids[key.ID] = true
+	}
+
+	return &apiKeys{
+		keys:  file.Keys,
+		audit: audit,
+	}, nil
+}
+
+// requestKey returns the key sent as a bearer token or X-API-Key header.
+func requestKey(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return req.Header.Get("X-API-Key")
+}
+
+// lookup returns the entry for key, comparing against every entry in
+// constant time.
+func (a *apiKeys) lookup(key string) *apiKey {
+	var rv *apiKey
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(a.keys[i].Key), []byte(key)) == 1 {
+			rv = &a.keys[i]
+		}
+	}
+	return rv
+}
+
+type apiKeyContextKey struct{}
+
+// requestKeyID returns the ID of the API key the request was made with,
+// or "" if it was anonymous.
+func requestKeyID(req *http.Request) string {
+	if key, ok := req.Context().Value(apiKeyContextKey{}).(*apiKey); ok {
+		return key.ID
+	}
+	return ""
+}
+
+// require wraps h so that it only serves requests made with a key that
+// has at least role r. Read access is also open to anonymous requests,
+// but a key that is sent must be valid. Requests needing more than read
+// access are written to the audit log.
+func (a *apiKeys) require(r role, h http.Handler) http.Handler {
+	if a == nil && r > roleRead {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			showError(w, req, fmt.Sprintf("%s access needs an API keys file", r), 403)
+		})
+	}
+	if a == nil || a.open {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sent := requestKey(req)
+		if sent == "" && r == roleRead {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		key := a.lookup(sent)
+		if key == nil {
+			if sent == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="beer-search"`)
+				showError(w, req, "an API key is required", 401)
+			} else {
+				showError(w, req, "invalid API key", 401)
+			}
+			return
+		}
+		if key.Role < r {
+			showError(w, req, fmt.Sprintf("API key '%s' does not have %s access", key.ID, r), 403)
+			return
+		}
+
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+		if r == roleRead {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, req)
+		a.logWrite(req, key, rec.status)
+	})
+}
+
+// logWrite appends one JSON line describing a write to the audit log.
+func (a *apiKeys) logWrite(req *http.Request, key *apiKey, status int) {
+	entry := struct {
+		Time   time.Time `json:"time"`
+		KeyID  string    `json:"key_id"`
+		Method string    `json:"method"`
+		Path   string    `json:"path"`
+		Status int       `json:"status"`
+		Remote string    `json:"remote"`
+	}{
+		Time:   time.Now().UTC(),
+		KeyID:  key.ID,
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Status: status,
+		Remote: req.RemoteAddr,
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("error writing audit log: %v", err)
+		return
+	}
+
+	a.auditMutex.Lock()
+	defer a.auditMutex.Unlock()
+	if _, err := a.audit.Write(append(b, '\n')); err != nil {
+		log.Printf("error writing audit log: %v", err)
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,157 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIKeyRoles(t *testing.T) {
+	keysPath := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(keysPath, []byte(`{"keys": [
+		{"id": "reader", "key": "r-secret", "role": "read"},
+		{"id": "writer", "key": "w-secret", "role": "write"},
+		{"id": "admin", "key": "a-secret", "role": "admin"}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var audit bytes.Buffer
+	keys, err := loadAPIKeys(keysPath, &audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	handlers := map[role]http.Handler{
+		roleRead:  keys.require(roleRead, ok),
+		roleWrite: keys.require(roleWrite, ok),
+		roleAdmin: keys.require(roleAdmin, ok),
+	}
+
+	tests := []struct {
+		role   role
+		key    string
+		status int
+	}{
+		{roleRead, "", http.StatusCreated},
+		{roleRead, "r-secret", http.StatusCreated},
+		{roleRead, "wrong", http.StatusUnauthorized},
+		{roleWrite, "", http.StatusUnauthorized},
+		{roleWrite, "wrong", http.StatusUnauthorized},
+		{roleWrite, "r-secret", http.StatusForbidden},
+		{roleWrite, "w-secret", http.StatusCreated},
+		{roleWrite, "a-secret", http.StatusCreated},
+		{roleAdmin, "w-secret", http.StatusForbidden},
+		{roleAdmin, "a-secret", http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/api/test", nil)
+		if test.key != "" {
+			req.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		rec := httptest.NewRecorder()
+		handlers[test.role].ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s access with key %q: expected status %d, got %d", test.role, test.key, test.status, rec.Code)
+		}
+		if rec.Code >= 400 {
+			var body apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Status != rec.Code || body.Code == "" || body.Message == "" {
+				t.Errorf("expected JSON error body, got %q", rec.Body.String())
+			}
+		}
+	}
+
+	// the X-API-Key header works too
+	req := httptest.NewRequest("PUT", "/api/doc/x", nil)
+	req.Header.Set("X-API-Key", "w-secret")
+	rec := httptest.NewRecorder()
+	handlers[roleWrite].ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected X-API-Key to be accepted, got status %d", rec.Code)
+	}
+
+	// every allowed write was audited, by key id and never by key
+	var entries []map[string]interface{}
+	dec := json.NewDecoder(&audit)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 audit entries, got %d", len(entries))
+	}
+	last := entries[3]
+	if last["key_id"] != "writer" || last["method"] != "PUT" || last["path"] != "/api/doc/x" || last["status"] != float64(201) {
+		t.Errorf("unexpected audit entry %v", last)
+	}
+	if bytes.Contains(audit.Bytes(), []byte("secret")) {
+		t.Errorf("audit log contains a key")
+	}
+}
+
+func TestLoadAPIKeysErrors(t *testing.T) {
+	for _, keysFile := range []string{
+		`{"keys": [{"id": "a", "key": "x", "role": "superuser"}]}`,
+		`{"keys": [{"id": "a", "role": "read"}]}`,
+		`{"keys": [{"id": "a", "key": "x", "role": "read"}, {"id": "a", "key": "y", "role": "read"}]}`,
+	} {
+		keysPath := filepath.Join(t.TempDir(), "keys.json")
+		if err := os.WriteFile(keysPath, []byte(keysFile), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAPIKeys(keysPath, nil); err == nil {
+			t.Errorf("expected error loading %s", keysFile)
+		}
+	}
+}
+
+func TestNoAPIKeys(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	var keys *apiKeys
+	open := &apiKeys{open: true}
+
+	// without a keys file, only reading is allowed, unless opened up
+	for _, test := range []struct {
+		keys   *apiKeys
+		role   role
+		status int
+	}{
+		{keys, roleRead, http.StatusCreated},
+		{keys, roleWrite, http.StatusForbidden},
+		{keys, roleAdmin, http.StatusForbidden},
+		{open, roleWrite, http.StatusCreated},
+		{open, roleAdmin, http.StatusCreated},
+	} {
+		req := httptest.NewRequest("POST", "/api/test", nil)
+		req.Header.Set("Authorization", "Bearer anything")
+		rec := httptest.NewRecorder()
+		test.keys.require(test.role, ok).ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s access, open %t: expected status %d, got %d", test.role, test.keys != nil, test.status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var backupDir = flag.String("backupDir", "backups/", "directory for backups made through the admin API")
+
+// isArchive reports whether path names a tar.gz backup rather than a
+// backup directory.
+func isArchive(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// backupIndex writes a point-in-time copy of idx to dest, which is
+// either a directory or, if it ends in .tar.gz or .tgz, an archive. The
+// index stays fully usable while the copy is made. Nothing is left at
+// dest if the backup fails.
+func backupIndex(idx bleve.Index, dest string) error {
+	copyable, ok := idx.(bleve.IndexCopyable)
+	if !ok {
+		return fmt.Errorf("index does not support online copy")
+	}
+
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("backup destination %s already exists", dest)
+	}
+
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dest), ".backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = copyable.CopyTo(bleve.FileSystemDirectory(tmpDir))
+	if err != nil {
+		return err
+	}
+
+	if !isArchive(dest) {
+		return os.Rename(tmpDir, dest)
+	}
+
+	tmpArchive := tmpDir + ".tar.gz"
+	err = writeArchive(tmpDir, tmpArchive)
+	if err != nil {
+		os.Remove(tmpArchive)
+		return err
+	}
+	return os.Rename(tmpArchive, dest)
+}
+
+// restoreIndex replaces the index at indexPath with the backup at src,
+// a directory or archive made by backupIndex. The backup is unpacked
+// next to indexPath and opened to check that it is a usable index before
+// anything is replaced. The previous index, if any, is kept alongside
+// and its new path returned. The index must not be open.
+func restoreIndex(src, indexPath string) (string, error) {
+	staging := fmt.Sprintf("%s.restore-%d", indexPath, time.Now().Unix())
+	var err error
+	if isArchive(src) {
+		err = extractArchive(src, staging)
+	} else {
+		err = copyDir(src, staging)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	// make sure what we restore is really an index
+	count, err := checkIndex(staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", fmt.Errorf("invalid backup %s: %v", src, err)
+	}
+	log.Printf("Backup %s contains %d documents", src, count)
+
+	var previous string
+	if _, err := os.Stat(indexPath); err == nil {
+		previous = fmt.Sprintf("%s.before-restore-%d", indexPath, time.Now().Unix())
+		err = os.Rename(indexPath, previous)
+		if err != nil {
+			os.RemoveAll(staging)
+			return "", err
+		}
+	}
+
+	if err := os.Rename(staging, indexPath); err != nil {
+		if previous != "" {
+			os.Rename(previous, indexPath)
+		}
+		os.RemoveAll(staging)
+		return "", err
+	}
+	return previous, nil
+}
+
+// checkIndex opens the index at path and returns its document count.
+func checkIndex(path string) (uint64, error) {
+	idx, err := openCommandIndex(path, true)
+	if err != nil {
+		return 0, err
+	}
+	count, err := idx.DocCount()
+	if cerr := idx.Close(); err == nil {
+		err = cerr
+	}
+	return count, err
+}
+
+// writeArchive writes the contents of dir to a gzipped tarball at path.
+func writeArchive(dir, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// extractArchive unpacks a gzipped tarball made by writeArchive into
+// dir, rejecting entries that would land outside it.
+func extractArchive(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("archive entry %q is outside the index", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0700)
+		case tar.TypeReg:
+			err = writeFile(target, tr)
+		default:
+			err = fmt.Errorf("archive entry %q is not a file or directory", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyDir recursively copies the regular files and directories in src
+// to dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a file or directory", path)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeFile(target, f)
+	})
+}
+
+func writeFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// backupHandler makes a backup of the live index in a directory on the
+// server. The format request parameter selects "tar.gz" (the default)
+// or "dir".
+type backupHandler struct {
+	live *liveIndex
+	dir  string
+}
+
+func newBackupHandler(live *liveIndex, dir string) *backupHandler {
+	return &backupHandler{
+		live: live,
+		dir:  dir,
+	}
+}
+
+func (h *backupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := fmt.Sprintf("beer-search-%s", time.Now().UTC().Format("20060102T150405.000"))
+	switch format := req.FormValue("format"); format {
+	case "", "tar.gz":
+		name += ".tar.gz"
+	case "dir":
+	default:
+		showError(w, req, fmt.Sprintf("unknown backup format '%s'", format), 400)
+		return
+	}
+
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		showError(w, req, fmt.Sprintf("error creating backup directory: %v", err), 500)
+		return
+	}
+	dest := filepath.Join(h.dir, name)
+
+	startTime := time.Now()
+	err := h.live.Use(func(index bleve.Index) error {
+		return backupIndex(index, dest)
+	})
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error making backup: %v", err), 500)
+		return
+	}
+	log.Printf("Backed up index to %s in %v", dest, time.Since(startTime))
+
+	rv := struct {
+		Status string `json:"status"`
+		Path   string `json:"path"`
+	}{
+		Status: "ok",
+		Path:   dest,
+	}
+	mustEncode(w, rv)
+}
+
+// backupCommand implements the backup subcommand, which copies the
+// index at -index to the path given as its argument. Use the admin API
+// instead while the server is running, as it holds the index open.
+func backupCommand(args []string) int {
+	if len(args) != 1 {
+		log.Printf("usage: beer-search [flags] backup <dir or file.tar.gz>")
+		return 2
+	}
+
+	path, err := activeIndexPath(*indexPath)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	idx, err := openCommandIndex(path, true)
+	if errors.Is(err, bbolt.ErrTimeout) {
+		log.Printf("%v; use POST /api/admin/backup while the server is running", err)
+		return 1
+	} else if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer idx.Close()
+
+	if err := backupIndex(idx, args[0]); err != nil {
+		log.Print(err)
+		return 1
+	}
+	log.Printf("Backed up %s to %s", path, args[0])
+	return 0
+}
+
+// restoreCommand implements the restore subcommand, which replaces the
+// index at -index with the backup given as its argument. The server must
+// not be running.
+func restoreCommand(args []string) int {
+	if len(args) != 1 {
+		log.Printf("usage: beer-search [flags] restore <dir or file.tar.gz>")
+		return 2
+	}
+
+	path, err := activeIndexPath(*indexPath)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	previous, err := restoreIndex(args[0], path)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if previous != "" {
+		log.Printf("Previous index moved to %s", previous)
+	}
+	log.Printf("Restored %s from %s", path, args[0])
+	return 0
+}
@@ -0,0 +1,201 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+func TestBackupRestore(t *testing.T) {
+	tempDir := t.TempDir()
+
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := bleve.New(filepath.Join(tempDir, "beer-search.bleve"), mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	indexTestBeer(t, index, 100)
+
+	for _, name := range []string{"backup", "backup.tar.gz"} {
+		backupPath := filepath.Join(tempDir, name)
+		err = backupIndex(index, backupPath)
+		if err != nil {
+			t.Fatalf("backup to %s: %v", name, err)
+		}
+
+		err = backupIndex(index, backupPath)
+		if err == nil {
+			t.Errorf("expected backup over existing %s to fail", name)
+		}
+
+		restorePath := filepath.Join(tempDir, "restored-"+name+".bleve")
+		previous, err := restoreIndex(backupPath, restorePath)
+		if err != nil {
+			t.Fatalf("restore from %s: %v", name, err)
+		}
+		if previous != "" {
+			t.Errorf("expected no previous index, got %s", previous)
+		}
+
+		count, err := checkIndex(restorePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 100 {
+			t.Errorf("expected 100 documents restored from %s, got %d", name, count)
+		}
+
+		// restoring again keeps the index it replaces
+		previous, err = restoreIndex(backupPath, restorePath)
+		if err != nil {
+			t.Fatalf("second restore from %s: %v", name, err)
+		}
+		if _, err := os.Stat(previous); err != nil {
+			t.Errorf("expected previous index to be kept: %v", err)
+		}
+	}
+
+	// a directory that isn't an index is rejected
+	notIndex := filepath.Join(tempDir, "not-an-index")
+	if err := os.Mkdir(notIndex, 0700); err != nil {
+		t.Fatal(err)
+	}
+	_, err = restoreIndex(notIndex, filepath.Join(tempDir, "restored-bad.bleve"))
+	if err == nil {
+		t.Errorf("expected restore of a non-index to fail")
+	}
+}
+
+func TestBackupDuringReindex(t *testing.T) {
+	tempDir := t.TempDir()
+	useTestData(t, 200)
+
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(tempDir, "beer-search.bleve")
+	index, err := bleve.New(base, mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexTestBeer(t, index, 10)
+
+	live := newLiveIndex("beer-backup-test", base, index, base, nil)
+	defer bleveHttp.UnregisterIndexByName("beer-backup-test")
+	defer live.Close()
+	handler := newBackupHandler(live, filepath.Join(tempDir, "backups"))
+
+	if err := live.Reindex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	live.wg.Wait()
+
+	// a rollback waits for a backup of the index it replaces
+	backingUp, finishBackup := make(chan struct{}), make(chan struct{})
+	backedUp := make(chan error, 1)
+	go func() {
+		backedUp <- live.Use(func(index bleve.Index) error {
+			close(backingUp)
+			<-finishBackup
+			return backupIndex(index, filepath.Join(tempDir, "backup"))
+		})
+	}()
+	<-backingUp
+	rolledBack := make(chan error, 1)
+	go func() {
+		rolledBack <- live.Rollback()
+	}()
+	select {
+	case <-rolledBack:
+		t.Fatal("expected the rollback to wait for the backup")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(finishBackup)
+	if err := <-backedUp; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rolledBack; err != nil {
+		t.Fatal(err)
+	}
+	count, err := checkIndex(filepath.Join(tempDir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 200 {
+		t.Errorf("expected a backup of the reindexed 200 documents, got %d", count)
+	}
+
+	// and backups through the handler are of the index now served
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/admin/backup?format=dir", nil))
+	var rv struct {
+		Path string `json:"path"`
+	}
+	if rec.Code != 200 || json.Unmarshal(rec.Body.Bytes(), &rv) != nil {
+		t.Fatalf("expected a backup, got %d %s", rec.Code, rec.Body.String())
+	}
+	if count, err := checkIndex(rv.Path); err != nil || count != 10 {
+		t.Errorf("expected a backup of the 10 documents rolled back to, got %d, %v", count, err)
+	}
+}
+
+func TestBackupCommand(t *testing.T) {
+	tempDir := t.TempDir()
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tempDir, "beer-search.bleve")
+	index, err := bleve.New(path, mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexTestBeer(t, index, 10)
+
+	defer func(old string) { *indexPath = old }(*indexPath)
+	*indexPath = path
+
+	// the server holding the index open makes the command fail, rather
+	// than wait
+	start := time.Now()
+	if code := backupCommand([]string{filepath.Join(tempDir, "held")}); code != 1 {
+		t.Errorf("expected backing up a held index to fail, got %d", code)
+	}
+	if elapsed := time.Since(start); elapsed > 10*indexLockTimeout {
+		t.Errorf("expected backing up a held index to fail fast, took %v", elapsed)
+	}
+
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backupPath := filepath.Join(tempDir, "backup")
+	if code := backupCommand([]string{backupPath}); code != 0 {
+		t.Fatalf("expected the backup to succeed, got %d", code)
+	}
+	if count, err := checkIndex(backupPath); err != nil || count != 10 {
+		t.Errorf("expected 10 documents backed up, got %d %v", count, err)
+	}
+}
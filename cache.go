@@ -0,0 +1,188 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+var (
+	searchCacheSize = flag.Int("searchCacheSize", 1000, "number of search results to cache (0 to disable)")
+	searchCacheTTL  = flag.Duration("searchCacheTTL", time.Minute, "how long a cached search result may be served")
+)
+
+// indexVersion counts changes to the served index. Cached search results
+// remember the version they were computed at, and are only used while it
+// is current.
+var indexVersion atomic.Uint64
+
+// indexChanged must be called after every write to the served index.
+func indexChanged() {
+	indexVersion.Add(1)
+}
+
+var searchCacheStats = expvar.NewMap("searchCache")
+
+// cachedSearch is an encoded search response.
+type cachedSearch struct {
+	key     string
+	version uint64
+	created time.Time
+	body    []byte
+	etag    string
+	hits    uint64
+}
+
+// searchCache is an LRU cache of encoded search responses, keyed by the
+// canonical JSON of the search request.
+type searchCache struct {
+	size int
+	ttl  time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newSearchCache(size int, ttl time.Duration) *searchCache {
+	if size <= 0 {
+		return nil
+	}
+	return &searchCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// searchCacheKey returns the cache key for searchRequest on the named
+// index. Re-encoding the parsed request, rather than using the request
+// body, makes requests that differ only in formatting, key order or
+// defaults share an entry.
+func searchCacheKey(indexName string, searchRequest *bleve.SearchRequest) (string, error) {
+	b, err := json.Marshal(searchRequest)
+	if err != nil {
+		return "", err
+	}
+	return indexName + "\x00" + string(b), nil
+}
+
+// get returns the cached response for key, if there is one from the
+// current index version that hasn't expired. A nil *searchCache caches
+// nothing.
+func (c *searchCache) get(key string) *cachedSearch {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		searchCacheStats.Add("misses", 1)
+		return nil
+	}
+	entry := el.Value.(*cachedSearch)
+	if entry.version != indexVersion.Load() || time.Since(entry.created) > c.ttl {
+		c.remove(el)
+		searchCacheStats.Add("misses", 1)
+		searchCacheStats.Add("invalidations", 1)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	searchCacheStats.Add("hits", 1)
+	return entry
+}
+
+// put caches body as the response for key, computed at index version,
+// with the number of hits found, and returns the entry.
+func (c *searchCache) put(key string, version uint64, body []byte, hits uint64) *cachedSearch {
+	entry := &cachedSearch{
+		key:     key,
+		version: version,
+		created: time.Now(),
+		body:    body,
+		etag:    searchETag(body),
+		hits:    hits,
+	}
+	if c == nil {
+		return entry
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		searchCacheStats.Add("evictions", 1)
+	}
+	searchCacheStats.Set("entries", expvarInt(c.lru.Len()))
+	return entry
+}
+
+func (c *searchCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cachedSearch).key)
+	searchCacheStats.Set("entries", expvarInt(c.lru.Len()))
+}
+
+func expvarInt(i int) *expvar.Int {
+	rv := new(expvar.Int)
+	rv.Set(int64(i))
+	return rv
+}
+
+// searchETag returns a strong ETag for a response body.
+func searchETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeCachedSearch writes a search response with its ETag, or just 304
+// Not Modified if the client already has it. Clients must revalidate
+// before reusing a response, since any write may change it.
+func writeCachedSearch(w http.ResponseWriter, req *http.Request, entry *cachedSearch, cacheStatus string) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("X-Cache", cacheStatus)
+	if etagMatches(req.Header.Get("If-None-Match"), entry.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(entry.body)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+func TestSearchCacheLRU(t *testing.T) {
+	c := newSearchCache(2, time.Minute)
+	version := indexVersion.Load()
+
+	c.put("a", version, []byte("A"), 0)
+	c.put("b", version, []byte("B"), 0)
+	if c.get("a") == nil {
+		t.Fatalf("expected a to be cached")
+	}
+	// b is now the least recently used
+	c.put("c", version, []byte("C"), 0)
+	if c.get("b") != nil {
+		t.Errorf("expected b to be evicted")
+	}
+	if entry := c.get("a"); entry == nil || string(entry.body) != "A" {
+		t.Errorf("expected a to be cached, got %v", entry)
+	}
+
+	// entries from before a change are not used
+	indexChanged()
+	if c.get("a") != nil {
+		t.Errorf("expected a to be invalidated by a change to the index")
+	}
+
+	c = newSearchCache(2, time.Nanosecond)
+	c.put("a", indexVersion.Load(), []byte("A"), 0)
+	time.Sleep(time.Millisecond)
+	if c.get("a") != nil {
+		t.Errorf("expected a to expire")
+	}
+
+	if newSearchCache(0, time.Minute) != nil {
+		t.Errorf("expected a zero size to disable the cache")
+	}
+}
+
+func TestSearchCacheKey(t *testing.T) {
+	var keys []string
+	for _, body := range []string{
+		`{"query": {"query": "ale"}, "size": 10}`,
+		`{"size":10,"query":{"query":"ale"}}`,
+		`{"query": {"query": "ale"}}`,
+	} {
+		var req bleve.SearchRequest
+		if err := req.UnmarshalJSON([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		key, err := searchCacheKey("beer", &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if keys[0] != keys[1] || keys[0] != keys[2] {
+		t.Errorf("expected equivalent requests to share a key, got %q", keys)
+	}
+}
+
+func TestSearchHandlerCache(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 100)
+	bleveHttp.RegisterIndexName("beer-cache-test", changeTrackingIndex{IndexAlias: bleve.NewIndexAlias(index)})
+	defer bleveHttp.UnregisterIndexByName("beer-cache-test")
+
+	handler := newSearchHandler("beer-cache-test", time.Minute, newSearchCache(10, time.Minute))
+	search := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/search", strings.NewReader(`{"query": {"query": "ale"}}`))
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := search("")
+	if first.Code != 200 || first.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected first search to miss, got %d %s", first.Code, first.Header().Get("X-Cache"))
+	}
+	second := search("")
+	if second.Header().Get("X-Cache") != "HIT" || second.Body.String() != first.Body.String() {
+		t.Errorf("expected second search to hit with the same body")
+	}
+	etag := first.Header().Get("ETag")
+	if revalidated := search(etag); revalidated.Code != 304 || revalidated.Body.Len() != 0 {
+		t.Errorf("expected 304 for a matching ETag, got %d", revalidated.Code)
+	}
+
+	// writing through the registered index invalidates the cache
+	err = bleveHttp.IndexByName("beer-cache-test").Index("new-ale", map[string]interface{}{"name": "new ale", "type": "beer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := search(etag)
+	if third.Code != 200 || third.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected a fresh result after a write, got %d %s", third.Code, third.Header().Get("X-Cache"))
+	}
+	if !strings.Contains(third.Body.String(), "new-ale") {
+		t.Errorf("expected the new document in the results")
+	}
+}
@@ -0,0 +1,269 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Package client calls the beer-search API, as described by the
+// server's /api/openapi.json. Searches are bleve search requests and
+// results, so callers build queries with bleve rather than by hand.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// Client calls the API of one server. Its fields must not be changed
+// while it is in use.
+type Client struct {
+	// BaseURL is where the server is, like http://localhost:8094.
+	BaseURL string
+	// APIKey, if set, is sent as a bearer token.
+	APIKey string
+	// HTTPClient makes the requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Error is an error response from the server.
+type Error struct {
+	Status    int             `json:"status"`
+	Code      string          `json:"code"`
+	Message   string          `json:"message"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("beer-search: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// SearchResult is bleve's search result, with the cursor for the page
+// after it.
+type SearchResult struct {
+	bleve.SearchResult
+	Next string `json:"next,omitempty"`
+}
+
+// SearchOptions are the parameters of a search besides the request.
+type SearchOptions struct {
+	// Cursor continues after the page whose Next it is.
+	Cursor string
+	// Timeout is how long the search may run, if less than the server
+	// allows.
+	Timeout time.Duration
+}
+
+// FieldTerm is a term of a field and how many documents have it.
+type FieldTerm struct {
+	Term  string `json:"term"`
+	Count uint64 `json:"count"`
+}
+
+// FieldTerms is a page of the terms of a field.
+type FieldTerms struct {
+	Field string      `json:"field"`
+	Terms []FieldTerm `json:"terms"`
+	More  bool        `json:"more"`
+}
+
+// HistogramBucket counts the values of a numeric field from Min to Max.
+type HistogramBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count uint64  `json:"count"`
+}
+
+// FieldStats summarizes the values of a numeric field.
+type FieldStats struct {
+	Field     string            `json:"field"`
+	Count     uint64            `json:"count"`
+	Distinct  int               `json:"distinct"`
+	Min       float64           `json:"min"`
+	Max       float64           `json:"max"`
+	Mean      float64           `json:"mean"`
+	Histogram []HistogramBucket `json:"histogram"`
+}
+
+// Document is the stored fields of a document.
+type Document struct {
+	ID     string                 `json:"id"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// DebugRow is a row of the index about a document.
+type DebugRow struct {
+	Key []byte `json:"key"`
+	Val []byte `json:"val"`
+}
+
+// Search runs req. opts may be nil.
+func (c *Client) Search(ctx context.Context, req *bleve.SearchRequest, opts *SearchOptions) (*SearchResult, error) {
+	params := url.Values{}
+	if opts != nil {
+		if opts.Cursor != "" {
+			params.Set("cursor", opts.Cursor)
+		}
+		if opts.Timeout > 0 {
+			params.Set("timeout", opts.Timeout.String())
+		}
+	}
+	var rv SearchResult
+	if err := c.do(ctx, "POST", "/api/search", params, req, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// Fields lists the indexed fields.
+func (c *Client) Fields(ctx context.Context) ([]string, error) {
+	var rv struct {
+		Fields []string `json:"fields"`
+	}
+	if err := c.do(ctx, "GET", "/api/fields", nil, nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv.Fields, nil
+}
+
+// FieldTerms lists up to limit terms of field starting with prefix, or
+// the server's default number if limit is 0.
+func (c *Client) FieldTerms(ctx context.Context, field, prefix string, limit int) (*FieldTerms, error) {
+	params := url.Values{}
+	if prefix != "" {
+		params.Set("prefix", prefix)
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	var rv FieldTerms
+	if err := c.do(ctx, "GET", "/api/fields/"+url.PathEscape(field)+"/terms", params, nil, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// FieldStats summarizes numeric field, with a histogram of buckets, or
+// the server's default number if buckets is 0.
+func (c *Client) FieldStats(ctx context.Context, field string, buckets int) (*FieldStats, error) {
+	params := url.Values{}
+	if buckets > 0 {
+		params.Set("buckets", strconv.Itoa(buckets))
+	}
+	var rv FieldStats
+	if err := c.do(ctx, "GET", "/api/fields/"+url.PathEscape(field)+"/stats", params, nil, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// Document gets the stored fields of the document id.
+func (c *Client) Document(ctx context.Context, id string) (*Document, error) {
+	var rv Document
+	if err := c.do(ctx, "GET", "/api/doc/"+url.PathEscape(id), nil, nil, &rv); err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// IndexDocument indexes doc, which must encode as a JSON object, as id.
+func (c *Client) IndexDocument(ctx context.Context, id string, doc interface{}) error {
+	return c.do(ctx, "PUT", "/api/doc/"+url.PathEscape(id), nil, doc, nil)
+}
+
+// DeleteDocument deletes the document id.
+func (c *Client) DeleteDocument(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/api/doc/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// Debug returns the index rows of the document id, which needs an admin
+// key.
+func (c *Client) Debug(ctx context.Context, id string) ([]DebugRow, error) {
+	var rv []DebugRow
+	if err := c.do(ctx, "GET", "/api/debug/"+url.PathEscape(id), nil, nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// do sends body, if not nil, as JSON to path and decodes the response
+// into rv, if not nil. Error responses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, body, rv interface{}) error {
+	u := c.BaseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{}
+		if json.Unmarshal(respBody, apiErr) != nil || apiErr.Message == "" {
+			// not from the API, perhaps from a proxy in front of it
+			apiErr = &Error{Message: strings.TrimSpace(string(respBody))}
+		}
+		apiErr.Status = resp.StatusCode
+		if apiErr.Code == "" {
+			apiErr.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(resp.StatusCode)), " ", "_")
+		}
+		return apiErr
+	}
+	if rv == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, rv); err != nil {
+		return fmt.Errorf("beer-search: error decoding response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,517 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// commandUsage is printed by -h, after the usage line and before the
+// flags.
+const commandUsage = `usage: beer-search [flags] [command] [args]
+
+commands:
+  serve                    serve the index and UI (the default)
+  index                    build or update the index from -jsonDir
+  query [flags] <query>    search, with a query string or a JSON query
+  stats [flags]            count documents by type and describe the fields
+  dump [flags]             write every document
+  backup <dir or file>     back up the index
+  restore <dir or file>    replace the index with a backup
+
+flags:
+`
+
+// indexLockTimeout is how long commands wait for an index that another
+// process, such as the server, has open.
+const indexLockTimeout = time.Second
+
+// openCommandIndex opens the index at path for a command, failing rather
+// than waiting if the server has it open.
+func openCommandIndex(path string, readOnly bool) (bleve.Index, error) {
+	idx, err := openIndexUsing(path, map[string]interface{}{
+		"read_only":    readOnly,
+		"bolt_timeout": indexLockTimeout.String(),
+	})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is in use, perhaps by a running server: %w", path, err)
+	}
+	return idx, err
+}
+
+// openActiveIndex opens the index currently at -index to read.
+func openActiveIndex() (bleve.Index, error) {
+	path, err := activeIndexPath(*indexPath)
+	if err != nil {
+		return nil, err
+	}
+	return openCommandIndex(path, true)
+}
+
+// indexCommand implements the index subcommand, which indexes the JSON
+// files in -jsonDir, creating the index if there isn't one and otherwise
+// updating the documents in it. The server must not be running. Saved
+// searches are checked when the index is created, as when the server
+// creates it; updates in place aren't checked, as there is no telling
+// which documents changed.
+func indexCommand(ctx context.Context, args []string) int {
+	if len(args) != 0 {
+		log.Printf("usage: beer-search [flags] index")
+		return 2
+	}
+
+	path, err := activeIndexPath(*indexPath)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	var indexed func(ids []string)
+	idx, err := openCommandIndex(path, false)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		log.Printf("Creating new index...")
+		indexMapping, err := buildIndexMapping()
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		idx, err = newIndex(path, indexMapping, *shardCount)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		saved, err := loadSavedSearches(*indexPath + ".saved.json")
+		if err != nil {
+			idx.Close()
+			log.Print(err)
+			return 1
+		}
+		defer saved.Close()
+		indexed = func(ids []string) {
+			saved.check(idx, ids, nil)
+		}
+	} else if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	count, err := indexBeer(ctx, idx, indexed)
+	if cerr := idx.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	log.Printf("Indexed %d documents into %s", count, path)
+	return 0
+}
+
+// queryCommand implements the query subcommand, which runs a search and
+// prints the hits. The query is in query string syntax, or, starting with
+// "{", a JSON query object or a whole search request as for /api/search.
+func queryCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	size := fs.Int("size", 10, "number of hits to print")
+	from := fs.Int("from", 0, "number of hits to skip")
+	sortBy := fs.String("sort", "", "comma separated fields to sort by, - prefixed for descending")
+	fields := fs.String("fields", "name,type", "comma separated stored fields to print, or *")
+	format := fs.String("format", "table", "table or json")
+	var filters []string
+	fs.Func("filter", "field:value that hits must match; may be repeated", func(s string) error {
+		filters = append(filters, s)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || (*format != "table" && *format != "json") {
+		log.Printf("usage: beer-search [flags] query [-size n] [-from n] [-sort fields] [-fields fields] [-filter field:value] [-format table|json] <query>")
+		return 2
+	}
+
+	searchRequest, err := commandSearchRequest(strings.Join(fs.Args(), " "), url.Values{
+		"size":   {fmt.Sprint(*size)},
+		"from":   {fmt.Sprint(*from)},
+		"sort":   {*sortBy},
+		"fields": {*fields},
+		"filter": filters,
+	})
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	idx, err := openActiveIndex()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer idx.Close()
+	searchResponse, err := idx.SearchInContext(ctx, searchRequest)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(searchResponse)
+	} else {
+		err = writeHitsTable(out, searchResponse, searchRequest.Fields)
+	}
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// commandSearchRequest builds the search request of the query
+// subcommand: a JSON search request as it is, or a query string or JSON
+// query object with the options in params, as for a GET of /api/search.
+func commandSearchRequest(q string, params url.Values) (*bleve.SearchRequest, error) {
+	if !strings.HasPrefix(strings.TrimSpace(q), "{") {
+		params.Set("q", q)
+		return searchRequestFromURL(params)
+	}
+
+	queryObject, err := query.ParseQuery([]byte(q))
+	if err != nil {
+		// not a query, so perhaps a search request, which must have one
+		var keys map[string]json.RawMessage
+		var searchRequest *bleve.SearchRequest
+		if json.Unmarshal([]byte(q), &keys) != nil || keys["query"] == nil ||
+			json.Unmarshal([]byte(q), &searchRequest) != nil {
+			return nil, fmt.Errorf("error parsing query: %v", err)
+		}
+		return searchRequest, nil
+	}
+	searchRequest, err := searchRequestFromURL(params)
+	if err != nil {
+		return nil, err
+	}
+	// searchRequestFromURL matches everything, in a conjunction if there
+	// are filters
+	if conjunction, ok := searchRequest.Query.(*query.ConjunctionQuery); ok {
+		conjunction.Conjuncts[0] = queryObject
+	} else {
+		searchRequest.Query = queryObject
+	}
+	return searchRequest, nil
+}
+
+// writeHitsTable writes a line for each hit, with its ID, score and
+// fields, and a summary line.
+func writeHitsTable(w io.Writer, searchResponse *bleve.SearchResult, fields []string) error {
+	if len(fields) == 1 && fields[0] == "*" {
+		fields = nil
+		seen := map[string]bool{}
+		for _, hit := range searchResponse.Hits {
+			for field := range hit.Fields {
+				if !seen[field] {
+					seen[field] = true
+					fields = append(fields, field)
+				}
+			}
+		}
+		sort.Strings(fields)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "ID\tSCORE")
+	for _, field := range fields {
+		fmt.Fprintf(tw, "\t%s", strings.ToUpper(field))
+	}
+	fmt.Fprintln(tw)
+	for _, hit := range searchResponse.Hits {
+		fmt.Fprintf(tw, "%s\t%.3f", hit.ID, hit.Score)
+		for _, field := range fields {
+			fmt.Fprintf(tw, "\t%s", strings.ReplaceAll(csvValue(hit.Fields[field]), "\t", " "))
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d of %d hits, in %v\n", len(searchResponse.Hits), searchResponse.Total, searchResponse.Took)
+	return err
+}
+
+// indexStats is what the stats subcommand prints.
+type indexStats struct {
+	Documents uint64            `json:"documents"`
+	Types     map[string]uint64 `json:"types"`
+	Fields    []fieldInfo       `json:"fields"`
+}
+
+// fieldInfo describes a field: its analyzer, and how many distinct terms
+// it has, or for numeric and date fields how many distinct values.
+type fieldInfo struct {
+	Name     string `json:"name"`
+	Analyzer string `json:"analyzer,omitempty"`
+	Terms    int    `json:"terms"`
+	Numeric  bool   `json:"numeric,omitempty"`
+}
+
+// statsCommand implements the stats subcommand, which prints the number
+// of documents of each type, and the fields of the index.
+func statsCommand(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	format := fs.String("format", "table", "table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || (*format != "table" && *format != "json") {
+		log.Printf("usage: beer-search [flags] stats [-format table|json]")
+		return 2
+	}
+
+	idx, err := openActiveIndex()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer idx.Close()
+	stats, err := collectIndexStats(idx)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(stats)
+	} else {
+		err = writeStatsTable(out, stats)
+	}
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+func collectIndexStats(idx bleve.Index) (*indexStats, error) {
+	rv := &indexStats{Types: map[string]uint64{}}
+	count, err := idx.DocCount()
+	if err != nil {
+		return nil, err
+	}
+	rv.Documents = count
+
+	// each type's type field may be analyzed differently, so each is
+	// counted with its own analyzer rather than from a facet
+	if m, ok := idx.Mapping().(*mapping.IndexMappingImpl); ok {
+		var typed uint64
+		for name, docMapping := range m.TypeMapping {
+			q := bleve.NewMatchQuery(name)
+			q.SetField(m.TypeField)
+			q.Analyzer = typeFieldAnalyzer(m, docMapping)
+			searchResponse, err := idx.Search(bleve.NewSearchRequestOptions(q, 0, 0, false))
+			if err != nil {
+				return nil, err
+			}
+			rv.Types[name] = searchResponse.Total
+			typed += searchResponse.Total
+		}
+		if typed < rv.Documents {
+			rv.Types[m.DefaultType] = rv.Documents - typed
+		}
+	}
+
+	fields, err := idx.Fields()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fields)
+	m := idx.Mapping()
+	for _, field := range fields {
+		if field == "_all" {
+			// every field's terms, not a field of its own
+			continue
+		}
+		info := fieldInfo{Name: field}
+		if !strings.HasPrefix(field, "_") {
+			info.Analyzer = m.AnalyzerNameForPath(field)
+		}
+		values, err := numericFieldValues(idx, field)
+		if err == nil && len(values) > 0 {
+			info.Numeric = true
+			info.Analyzer = ""
+			info.Terms = len(values)
+		} else if err == nil || errors.Is(err, errNotNumeric) {
+			err = walkFieldDict(idx, field, nil, func(string) bool {
+				info.Terms++
+				return true
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %v", field, err)
+		}
+		rv.Fields = append(rv.Fields, info)
+	}
+	return rv, nil
+}
+
+// typeFieldAnalyzer returns the analyzer of the type field of documents
+// of a type.
+func typeFieldAnalyzer(m *mapping.IndexMappingImpl, docMapping *mapping.DocumentMapping) string {
+	analyzer := m.DefaultAnalyzer
+	if docMapping.DefaultAnalyzer != "" {
+		analyzer = docMapping.DefaultAnalyzer
+	}
+	for _, name := range strings.Split(m.TypeField, ".") {
+		if docMapping = docMapping.Properties[name]; docMapping == nil {
+			return analyzer
+		}
+		if docMapping.DefaultAnalyzer != "" {
+			analyzer = docMapping.DefaultAnalyzer
+		}
+	}
+	for _, field := range docMapping.Fields {
+		if field.Analyzer != "" {
+			return field.Analyzer
+		}
+	}
+	return analyzer
+}
+
+func writeStatsTable(w io.Writer, stats *indexStats) error {
+	fmt.Fprintf(w, "%d documents\n\n", stats.Documents)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	var types []string
+	for t := range stats.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	fmt.Fprintln(tw, "TYPE\tDOCUMENTS")
+	for _, t := range types {
+		fmt.Fprintf(tw, "%s\t%d\n", t, stats.Types[t])
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "FIELD\tANALYZER\tTERMS")
+	for _, field := range stats.Fields {
+		analyzer := field.Analyzer
+		if field.Numeric {
+			analyzer = "(numeric)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", field.Name, analyzer, field.Terms)
+	}
+	return tw.Flush()
+}
+
+// dumpCommand implements the dump subcommand, which writes the stored
+// fields of every document, or of those matching a query, as the export
+// API does.
+func dumpCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	format := fs.String("format", "ndjson", "ndjson or csv")
+	columns := fs.String("columns", "", "comma separated fields to write, where _id and _score are the ID and score (default all)")
+	q := fs.String("q", "", "query string query for the documents to write (default all)")
+	output := fs.String("o", "-", "file to write to, or - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || (*format != "ndjson" && *format != "csv") {
+		log.Printf("usage: beer-search [flags] dump [-format ndjson|csv] [-columns fields] [-q query] [-o file]")
+		return 2
+	}
+	searchRequest, err := searchRequestFromURL(url.Values{"q": {*q}})
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	idx, err := openActiveIndex()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer idx.Close()
+
+	var f io.WriteCloser = nopCloser{os.Stdout}
+	if *output != "-" {
+		f, err = os.Create(*output)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	w := bufio.NewWriter(f)
+
+	var cols []string
+	if *columns != "" {
+		cols = strings.Split(*columns, ",")
+	}
+	var out exportWriter
+	if *format == "csv" {
+		if cols == nil {
+			cols, err = exportColumns(idx)
+		}
+		if err == nil {
+			out, err = newCSVExport(w, cols)
+		}
+	} else {
+		out = &ndjsonExport{enc: json.NewEncoder(w), columns: cols}
+	}
+
+	count := 0
+	if err == nil {
+		h := newExportHandler("", *searchTimeout)
+		searchRequest.Size = h.pageSize
+		searchRequest.Fields = []string{"*"}
+		if cols != nil {
+			searchRequest.Fields = cols
+		}
+		stableSort(searchRequest)
+		count, err = h.export(ctx, idx, searchRequest, out, w)
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Dump stopped after %d documents: %v", count, err)
+		return 1
+	}
+	log.Printf("Dumped %d documents", count)
+	return 0
+}
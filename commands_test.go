@@ -0,0 +1,118 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+func TestCommandSearchRequest(t *testing.T) {
+	params := func() url.Values {
+		return url.Values{"size": {"5"}, "fields": {"name"}, "filter": {"type:beer"}}
+	}
+
+	sr, err := commandSearchRequest("stout", params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Size != 5 || len(sr.Fields) != 1 || sr.Fields[0] != "name" {
+		t.Errorf("expected the options to be used, got %+v", sr)
+	}
+
+	sr, err = commandSearchRequest(`{"match": "stout", "field": "name"}`, params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conjunction, ok := sr.Query.(*query.ConjunctionQuery)
+	if !ok || len(conjunction.Conjuncts) != 2 {
+		t.Fatalf("expected the filter in a conjunction, got %T", sr.Query)
+	}
+	if _, ok := conjunction.Conjuncts[0].(*query.MatchQuery); !ok {
+		t.Errorf("expected the JSON query first, got %T", conjunction.Conjuncts[0])
+	}
+
+	sr, err = commandSearchRequest(`{"query": {"query": "stout"}, "size": 2}`, params())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Size != 2 || len(sr.Fields) != 0 {
+		t.Errorf("expected the search request as it is, got %+v", sr)
+	}
+
+	if _, err := commandSearchRequest(`{"nonsense": true}`, params()); err == nil {
+		t.Error("expected an error for a JSON object that isn't a query")
+	}
+}
+
+func TestCommandOutput(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 20)
+
+	stats, err := collectIndexStats(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var typed uint64
+	for _, count := range stats.Types {
+		typed += count
+	}
+	if stats.Documents != 20 || typed != 20 {
+		t.Errorf("expected 20 documents, all typed, got %+v", stats)
+	}
+	for _, field := range stats.Fields {
+		if field.Name == "_all" {
+			t.Error("expected _all not to be listed")
+		}
+		if field.Name == "abv" && (!field.Numeric || field.Terms == 0) {
+			t.Errorf("expected abv to be numeric, got %+v", field)
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeStatsTable(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "20 documents\n") {
+		t.Errorf("unexpected stats table:\n%s", buf.String())
+	}
+
+	sr, err := commandSearchRequest("*", url.Values{"size": {"3"}, "fields": {"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchResponse, err := index.Search(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := writeHitsTable(&buf, searchResponse, sr.Fields); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "ID ") || !strings.Contains(lines[0], "NAME") {
+		t.Errorf("expected a header, 3 hits and a summary, got:\n%s", buf.String())
+	}
+	if !strings.HasPrefix(lines[4], "3 of 20 hits") {
+		t.Errorf("unexpected summary %q", lines[4])
+	}
+}
@@ -0,0 +1,211 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configPath  = flag.String("config", "", "JSON or YAML file of settings, named as the flags (default $BEER_SEARCH_CONFIG)")
+	printConfig = flag.Bool("print-config", false, "print the effective settings as JSON and exit")
+)
+
+// envPrefix starts the environment variables that give settings, as
+// BEER_SEARCH_BATCH_SIZE for -batchSize.
+const envPrefix = "BEER_SEARCH_"
+
+// unconfigurable are the flags that only make sense on the command line.
+var unconfigurable = map[string]bool{
+	"config":       true,
+	"print-config": true,
+}
+
+// envName returns the environment variable for a flag, splitting words
+// at lower to upper case changes, so that searchCacheTTL is
+// BEER_SEARCH_SEARCH_CACHE_TTL.
+func envName(flagName string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	prev := rune(0)
+	for _, r := range flagName {
+		switch {
+		case r == '-':
+			r = '_'
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+		prev = r
+	}
+	return b.String()
+}
+
+// loadConfig sets the flags of fs that weren't given on the command line
+// from the environment, or failing that the config file. Empty
+// environment variables are ignored. getenv is os.Getenv, but for tests.
+func loadConfig(fs *flag.FlagSet, getenv func(string) string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		path = getenv(envPrefix + "CONFIG")
+	}
+	var file map[string]interface{}
+	if path != "" {
+		var err error
+		file, err = readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		for name := range file {
+			if f := fs.Lookup(name); f == nil || unconfigurable[name] {
+				return fmt.Errorf("%s: unknown setting '%s'", path, name)
+			}
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || unconfigurable[f.Name] {
+			return
+		}
+		if value := getenv(envName(f.Name)); value != "" {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", envName(f.Name), err))
+			}
+			return
+		}
+		value, ok := file[f.Name]
+		if !ok {
+			return
+		}
+		s, err := configString(value)
+		if err == nil {
+			err = f.Value.Set(s)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %v", path, f.Name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// readConfigFile reads a JSON or YAML file, by its extension.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rv map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(b, &rv)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &rv)
+	default:
+		return nil, fmt.Errorf("%s: config files must be .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return rv, nil
+}
+
+// configString turns a value from a config file into a flag value.
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("must be a string, number or boolean, not %T", value)
+}
+
+// validateConfig checks the settings, once loaded, for values that parse
+// but make no sense.
+func validateConfig() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(*batchSize > 0, "batchSize must be positive")
+	check(*shardCount > 0, "shards must be positive")
+	_, err := parseListenAddr(*bindAddr)
+	check(err == nil, "%v", err)
+	err = validateTLSConfig()
+	check(err == nil, "%v", err)
+	check(*jsonDir != "", "jsonDir is required")
+	check(*indexPath != "", "index is required")
+	check(*searchCacheSize >= 0, "searchCacheSize must not be negative")
+	check(*maxConcurrentSearches >= 0, "maxConcurrentSearches must not be negative")
+	check(*searchQueueLength >= 0, "searchQueue must not be negative")
+	check(*compressMinSize >= -1, "compressMinSize must be -1 or more")
+	check(*graphqlMaxCost > 0, "graphqlMaxCost must be positive")
+	for name, d := range map[string]time.Duration{
+		"searchTimeout":   *searchTimeout,
+		"searchCacheTTL":  *searchCacheTTL,
+		"searchQueueWait": *searchQueueWait,
+		"shutdownTimeout": *shutdownTimeout,
+	} {
+		check(d > 0, "%s must be positive", name)
+	}
+	_, err = parseRateLimits(*rateLimits)
+	check(err == nil, "rateLimits: %v", err)
+	_, err = newCORS(*corsOrigins, *corsMethods, *corsHeaders, *corsMaxAge)
+	check(err == nil, "%v", err)
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// writeConfig writes the value of every setting as a JSON object, which
+// can be used as a config file.
+func writeConfig(w io.Writer, fs *flag.FlagSet) error {
+	config := map[string]interface{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if unconfigurable[f.Name] {
+			return
+		}
+		value := interface{}(f.Value.String())
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch v := getter.Get().(type) {
+			case bool, int, int64, uint, uint64, float64:
+				value = v
+			}
+		}
+		config[f.Name] = value
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(config)
+}
@@ -0,0 +1,125 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"addr":                  "BEER_SEARCH_ADDR",
+		"batchSize":             "BEER_SEARCH_BATCH_SIZE",
+		"searchCacheTTL":        "BEER_SEARCH_SEARCH_CACHE_TTL",
+		"maxConcurrentSearches": "BEER_SEARCH_MAX_CONCURRENT_SEARCHES",
+	}
+	for flagName, expected := range tests {
+		if name := envName(flagName); name != expected {
+			t.Errorf("%s: expected %s, got %s", flagName, expected, name)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "beer-search.yaml")
+	err := os.WriteFile(yamlPath, []byte("addr: ':9000'\nbatchSize: 50\nsearchTimeout: 10s\nverbose: true\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFlags := func() (*flag.FlagSet, *string, *int, *time.Duration, *bool) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.Bool("print-config", false, "")
+		addr := fs.String("addr", ":8094", "")
+		batchSize := fs.Int("batchSize", 100, "")
+		searchTimeout := fs.Duration("searchTimeout", 30*time.Second, "")
+		verbose := fs.Bool("verbose", false, "")
+		return fs, addr, batchSize, searchTimeout, verbose
+	}
+	env := map[string]string{
+		"BEER_SEARCH_CONFIG":     yamlPath,
+		"BEER_SEARCH_BATCH_SIZE": "70",
+	}
+	getenv := func(name string) string {
+		return env[name]
+	}
+
+	// flags beat the environment, which beats the file
+	fs, addr, batchSize, searchTimeout, verbose := newFlags()
+	if err := fs.Parse([]string{"-addr", ":7000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, getenv); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != ":7000" || *batchSize != 70 || *searchTimeout != 10*time.Second || !*verbose {
+		t.Errorf("unexpected settings %s %d %v %v", *addr, *batchSize, *searchTimeout, *verbose)
+	}
+
+	var buf bytes.Buffer
+	if err := writeConfig(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	var printed map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &printed); err != nil {
+		t.Fatal(err)
+	}
+	if printed["batchSize"] != 70.0 || printed["searchTimeout"] != "10s" || printed["verbose"] != true {
+		t.Errorf("unexpected printed config %v", printed)
+	}
+	if _, ok := printed["config"]; ok {
+		t.Errorf("expected config not to be printed")
+	}
+
+	// the printed config can be loaded back
+	jsonPath := filepath.Join(dir, "printed.json")
+	if err := os.WriteFile(jsonPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs, addr, batchSize, _, _ = newFlags()
+	if err := fs.Parse([]string{"-config", jsonPath}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, func(string) string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != ":7000" || *batchSize != 70 {
+		t.Errorf("expected the printed settings, got %s %d", *addr, *batchSize)
+	}
+
+	errorTests := map[string]string{
+		"unknown.json": `{"bogus": 1}`,
+		"list.yaml":    "addr: [1, 2]",
+		"bad.yaml":     "batchSize: lots",
+		"config.toml":  "addr = ':1'",
+	}
+	for name, content := range errorTests {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fs, _, _, _, _ = newFlags()
+		if err := fs.Parse([]string{"-config", path}); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(fs, func(string) string { return "" }); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: expected an error naming the file, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	corsOrigins = flag.String("corsOrigins", "", "comma separated origins allowed to call the API from browsers, like https://*.example.com, or * for any (default none)")
+	corsMethods = flag.String("corsMethods", "GET,POST,PUT,DELETE", "comma separated methods allowed from other origins")
+	corsHeaders = flag.String("corsHeaders", "Content-Type,Authorization,X-API-Key,X-Request-ID,If-None-Match", "comma separated request headers allowed from other origins, or * for any")
+	corsMaxAge  = flag.Duration("corsMaxAge", 10*time.Minute, "how long browsers may cache a preflight response")
+)
+
+// corsExposedHeaders are the response headers scripts on other origins
+// may read.
+var corsExposedHeaders = []string{"ETag", "X-Request-ID", "X-Cache", "Retry-After", "Content-Disposition"}
+
+// cors lets browsers call the API from other origins, answering
+// preflight requests itself and adding the headers that allow the
+// response to be read to the rest. A nil *cors allows no other origins.
+type cors struct {
+	origins []string
+	methods []string
+	headers []string
+	maxAge  time.Duration
+}
+
+// newCORS returns the CORS policy for the comma separated lists of
+// origins, methods and headers, or nil if no origins are allowed.
+func newCORS(origins, methods, headers string, maxAge time.Duration) (*cors, error) {
+	rv := &cors{
+		origins: splitList(origins),
+		methods: splitList(strings.ToUpper(methods)),
+		headers: splitList(headers),
+		maxAge:  maxAge,
+	}
+	if len(rv.origins) == 0 {
+		return nil, nil
+	}
+	for _, origin := range rv.origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("CORS origin '%s' is not * or scheme://host[:port]", origin)
+		}
+	}
+	if maxAge < 0 {
+		return nil, fmt.Errorf("corsMaxAge must not be negative")
+	}
+	return rv, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var rv []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			rv = append(rv, part)
+		}
+	}
+	return rv
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin,
+// or "" if it isn't allowed. Origins match exactly, or a *. pattern
+// matches subdomains at any depth.
+func (c *cors) allowOrigin(origin string) string {
+	if c == nil || origin == "" {
+		return ""
+	}
+	origin = strings.TrimSuffix(origin, "/")
+	for _, allowed := range c.origins {
+		allowed = strings.TrimSuffix(allowed, "/")
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*."); ok {
+			if len(origin) > len(prefix)+len(suffix)+1 &&
+				strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+				strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(suffix)) {
+				return origin
+			}
+		}
+	}
+	return ""
+}
+
+func (c *cors) allowMethod(method string) bool {
+	for _, m := range c.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) allowHeaders(requested string) bool {
+	for _, header := range splitList(requested) {
+		allowed := false
+		for _, h := range c.headers {
+			if h == "*" || strings.EqualFold(h, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// wrap wraps router, which is used to check that preflight requests are
+// for a method the route they're for accepts.
+func (c *cors) wrap(router *mux.Router) http.Handler {
+	if c == nil {
+		return router
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			router.ServeHTTP(w, req)
+			return
+		}
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		allowed := c.allowOrigin(origin)
+
+		requestMethod := req.Header.Get("Access-Control-Request-Method")
+		if req.Method != http.MethodOptions || requestMethod == "" {
+			if allowed != "" {
+				header.Set("Access-Control-Allow-Origin", allowed)
+				header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			}
+			router.ServeHTTP(w, req)
+			return
+		}
+
+		// a preflight request, for a request of requestMethod
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		var match mux.RouteMatch
+		preflighted := req.Clone(req.Context())
+		preflighted.Method = requestMethod
+		routed := router.Match(preflighted, &match) && match.MatchErr == nil
+		if routed {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				if info := requestInfoFrom(req.Context()); info != nil {
+					info.route = template
+				}
+			}
+		}
+		requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+		switch {
+		case allowed == "":
+			showError(w, req, fmt.Sprintf("origin '%s' is not allowed", origin), 403)
+			return
+		case !routed || !c.allowMethod(requestMethod):
+			showError(w, req, fmt.Sprintf("%s is not allowed here from other origins", requestMethod), 403)
+			return
+		case !c.allowHeaders(requestHeaders):
+			showError(w, req, fmt.Sprintf("headers '%s' are not all allowed from other origins", requestHeaders), 403)
+			return
+		}
+		header.Set("Access-Control-Allow-Origin", allowed)
+		header.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+		if requestHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", requestHeaders)
+		}
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge/time.Second)))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,97 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCORS(t *testing.T) {
+	if _, err := newCORS("example.com", "GET", "", time.Minute); err == nil {
+		t.Error("expected an error for an origin without a scheme")
+	}
+	if c, err := newCORS("", "GET", "", time.Minute); c != nil || err != nil {
+		t.Errorf("expected no policy without origins, got %v, %v", c, err)
+	}
+
+	c, err := newCORS("https://*.example.com, http://localhost:3000", "get,post", "Content-Type,X-API-Key", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, expected := range map[string]string{
+		"https://app.example.com":   "https://app.example.com",
+		"https://a.b.example.com":   "https://a.b.example.com",
+		"https://example.com":       "",
+		"http://app.example.com":    "",
+		"https://app.example.com.x": "",
+		"http://localhost:3000":     "http://localhost:3000",
+		"http://localhost:3001":     "",
+	} {
+		if allowed := c.allowOrigin(origin); allowed != expected {
+			t.Errorf("%s: expected %q, got %q", origin, expected, allowed)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/search", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("{}"))
+	}).Methods("GET", "POST")
+	router.HandleFunc("/api/doc/{docID}", func(w http.ResponseWriter, req *http.Request) {}).Methods("DELETE")
+	h := c.wrap(router)
+	do := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("OPTIONS", "/api/search", map[string]string{
+		"Origin":                         "https://app.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "content-type",
+	})
+	if rec.Code != 204 || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rec.Header().Get("Access-Control-Allow-Methods") != "GET, POST" ||
+		rec.Header().Get("Access-Control-Allow-Headers") != "content-type" ||
+		rec.Header().Get("Access-Control-Max-Age") != "60" {
+		t.Errorf("expected the preflight to be allowed, got %d %v", rec.Code, rec.Header())
+	}
+
+	for _, headers := range []map[string]string{
+		{"Origin": "https://elsewhere.com", "Access-Control-Request-Method": "POST"},
+		{"Origin": "https://app.example.com", "Access-Control-Request-Method": "PUT"},
+		{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "X-Other"},
+	} {
+		if rec := do("OPTIONS", "/api/search", headers); rec.Code != 403 || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%v: expected the preflight to be refused, got %d", headers, rec.Code)
+		}
+	}
+	// the route takes DELETE, but the policy doesn't allow it
+	if rec := do("OPTIONS", "/api/doc/x", map[string]string{"Origin": "http://localhost:3000", "Access-Control-Request-Method": "DELETE"}); rec.Code != 403 {
+		t.Errorf("expected DELETE to be refused by the policy, got %d", rec.Code)
+	}
+
+	rec = do("GET", "/api/search", map[string]string{"Origin": "http://localhost:3000"})
+	if rec.Code != 200 || rec.Header().Get("Access-Control-Allow-Origin") != "http://localhost:3000" || rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("expected the response to be readable, got %d %v", rec.Code, rec.Header())
+	}
+	rec = do("GET", "/api/search", nil)
+	if rec.Code != 200 || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers without an Origin, got %v", rec.Header())
+	}
+}
@@ -0,0 +1,106 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+// searchCursor is the position of the last hit on a page of results,
+// which the next page starts after. Clients get it as an opaque token.
+type searchCursor struct {
+	Sort  json.RawMessage `json:"sort"`
+	After []string        `json:"after"`
+}
+
+// stableSort makes the sort order of searchRequest total, by breaking
+// ties on document ID, so that a cursor names exactly one position. No
+// sort means by descending score.
+func stableSort(searchRequest *bleve.SearchRequest) {
+	if len(searchRequest.Sort) == 0 {
+		searchRequest.SortBy([]string{"-_score"})
+	}
+	for _, s := range searchRequest.Sort {
+		if _, ok := s.(*search.SortDocID); ok {
+			return
+		}
+	}
+	searchRequest.Sort = append(searchRequest.Sort, &search.SortDocID{})
+}
+
+// applyCursor makes searchRequest continue after the position in token.
+// The request must have the same sort order as the one the token came
+// from, and start from the first hit.
+func applyCursor(searchRequest *bleve.SearchRequest, token string) error {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	var cursor searchCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return fmt.Errorf("invalid cursor")
+	}
+	sort, err := json.Marshal(searchRequest.Sort)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sort, cursor.Sort) || len(cursor.After) != len(searchRequest.Sort) {
+		return fmt.Errorf("cursor is for a different sort order")
+	}
+	if searchRequest.From != 0 {
+		return fmt.Errorf("cursor cannot be used with from")
+	}
+	searchRequest.SearchAfter = cursor.After
+	return nil
+}
+
+// nextCursor returns the token for the page after searchResponse, or ""
+// if it was the last.
+func nextCursor(searchRequest *bleve.SearchRequest, searchResponse *bleve.SearchResult) (string, error) {
+	if len(searchResponse.Hits) == 0 || len(searchResponse.Hits) < searchRequest.Size {
+		return "", nil
+	}
+	last := searchResponse.Hits[len(searchResponse.Hits)-1]
+	if searchRequest.SearchAfter == nil && uint64(searchRequest.From+len(searchResponse.Hits)) >= searchResponse.Total {
+		return "", nil
+	}
+
+	sort, err := json.Marshal(searchRequest.Sort)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(searchCursor{Sort: sort, After: searchAfter(searchRequest, last)})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// searchAfter returns the SearchAfter values that continue searchRequest
+// after hit.
+func searchAfter(searchRequest *bleve.SearchRequest, hit *search.DocumentMatch) []string {
+	after := make([]string, len(hit.Sort))
+	copy(after, hit.Sort)
+	for n, s := range searchRequest.Sort {
+		// hits carry a placeholder for the score, but bleve needs the
+		// score itself to continue after it
+		if s.RequiresScoring() && n < len(after) {
+			after[n] = strconv.FormatFloat(hit.Score, 'g', -1, 64)
+		}
+	}
+	return after
+}
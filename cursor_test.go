@@ -0,0 +1,103 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+func TestSearchCursor(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 300)
+
+	bleveHttp.RegisterIndexName("beer-cursor-test", index)
+	defer bleveHttp.UnregisterIndexByName("beer-cursor-test")
+	handler := newSearchHandler("beer-cursor-test", time.Minute, nil)
+
+	search := func(params url.Values) (int, searchPage) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/search?"+params.Encode(), nil))
+		var page searchPage
+		if rec.Code == 200 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, page
+	}
+
+	// walking every page, even through ties in abv and score, sees each
+	// hit once, in the same order as one big page
+	for _, sort := range []string{"-abv", ""} {
+		params := url.Values{"q": {"type:beer"}, "size": {"1000"}}
+		if sort != "" {
+			params.Set("sort", sort)
+		}
+		_, all := search(params)
+		if all.Total == 0 || all.Next != "" {
+			t.Fatalf("sort %q: expected every hit on one page, got %d and next %q", sort, all.Total, all.Next)
+		}
+
+		params.Set("size", "7")
+		var walked []string
+		for pages := 0; ; pages++ {
+			if pages > len(all.Hits) {
+				t.Fatalf("sort %q: cursor never ended", sort)
+			}
+			code, page := search(params)
+			if code != 200 {
+				t.Fatalf("sort %q: expected 200, got %d", sort, code)
+			}
+			for _, hit := range page.Hits {
+				walked = append(walked, hit.ID)
+			}
+			if page.Next == "" {
+				break
+			}
+			params.Set("cursor", page.Next)
+		}
+		if len(walked) != len(all.Hits) {
+			t.Fatalf("sort %q: expected %d hits, walked %d", sort, len(all.Hits), len(walked))
+		}
+		for i, hit := range all.Hits {
+			if walked[i] != hit.ID {
+				t.Errorf("sort %q: hit %d: expected %s, walked %s", sort, i, hit.ID, walked[i])
+				break
+			}
+		}
+	}
+
+	_, first := search(url.Values{"q": {"type:beer"}, "sort": {"-abv"}})
+	tests := []url.Values{
+		{"q": {"type:beer"}, "sort": {"name"}, "cursor": {first.Next}},
+		{"q": {"type:beer"}, "sort": {"-abv"}, "from": {"10"}, "cursor": {first.Next}},
+		{"q": {"type:beer"}, "cursor": {"not a cursor"}},
+	}
+	for _, params := range tests {
+		if code, _ := search(params); code != 400 {
+			t.Errorf("%v: expected 400, got %d", params, code)
+		}
+	}
+}
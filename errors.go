@@ -0,0 +1,228 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2/analysis"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/gorilla/mux"
+)
+
+// codeInvalidQuery is the error code of queries that don't parse or
+// validate.
+const codeInvalidQuery = "invalid_query"
+
+// apiError is the body of every error response. Code is a stable name
+// for the kind of error, for clients to check, and Details, if any, says
+// more, such as where in a query string a syntax error is.
+type apiError struct {
+	Status    int         `json:"status"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// errorCode returns the default error code for an HTTP status, its
+// status text in snake case, so that 404 is not_found.
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	text = strings.ToLower(strings.ReplaceAll(text, "'", ""))
+	return strings.Join(strings.FieldsFunc(text, func(r rune) bool {
+		return r == ' ' || r == '-'
+	}), "_")
+}
+
+// writeError writes e as the response, with the request's ID.
+func writeError(w http.ResponseWriter, req *http.Request, e apiError) {
+	if e.Code == "" {
+		e.Code = errorCode(e.Status)
+	}
+	if info := requestInfoFrom(req.Context()); info != nil {
+		e.RequestID = info.id
+	}
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// showErrorDetails reports an error with a code other than the status's
+// default, or with details.
+func showErrorDetails(w http.ResponseWriter, req *http.Request, msg string, status int, code string, details interface{}) {
+	log.Printf("Reporting error %v/%v", status, msg)
+	writeError(w, req, apiError{
+		Status:  status,
+		Code:    code,
+		Message: msg,
+		Details: details,
+	})
+}
+
+// invalidQueryError is a query sent by the client that doesn't parse or
+// validate.
+type invalidQueryError struct {
+	msg    string
+	detail *queryError
+}
+
+func (e *invalidQueryError) Error() string {
+	return e.msg
+}
+
+// newInvalidQueryError returns err, the error parsing or validating q, as
+// an invalidQueryError, with the position of the error if q is a query
+// string.
+func newInvalidQueryError(prefix string, q query.Query, err error) error {
+	detail := &queryError{Message: err.Error()}
+	if qsq, ok := q.(*query.QueryStringQuery); ok {
+		raw, _ := json.Marshal(qsq.Query)
+		if _, qErr := parseValidateQuery(raw); qErr != nil {
+			detail = qErr
+		}
+	}
+	return &invalidQueryError{msg: prefix + err.Error(), detail: detail}
+}
+
+// isInvalidQuery reports whether err, from parsing or running a search,
+// is a problem with the query rather than with the server: a query that
+// didn't parse or validate before the search ran, or one of the few
+// errors bleve has types for that only come up once it runs, such as a
+// bad regular expression or date. Other errors from a search, even if
+// caused by the query, are the server's.
+func isInvalidQuery(err error) bool {
+	var invalid *invalidQueryError
+	var syntaxErr *syntax.Error
+	return errors.As(err, &invalid) || errors.As(err, &syntaxErr) || errors.Is(err, analysis.ErrInvalidDateTime)
+}
+
+// showQueryError reports an error from parsing or running a search: as
+// 400 with code invalid_query if the query is at fault, and otherwise
+// with status.
+func showQueryError(w http.ResponseWriter, req *http.Request, err error, status int) {
+	var invalid *invalidQueryError
+	switch {
+	case errors.As(err, &invalid) && invalid.detail != nil:
+		showErrorDetails(w, req, err.Error(), 400, codeInvalidQuery, invalid.detail)
+	case isInvalidQuery(err):
+		showErrorDetails(w, req, err.Error(), 400, codeInvalidQuery, nil)
+	default:
+		showError(w, req, err.Error(), status)
+	}
+}
+
+// notFound is the router's handler for paths with no route.
+func notFound(w http.ResponseWriter, req *http.Request) {
+	showError(w, req, fmt.Sprintf("no such endpoint '%s'", req.URL.Path), 404)
+}
+
+// allMethods are the methods methodNotAllowed checks routes for.
+var allMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// methodNotAllowed returns the router's handler for routes that don't
+// take the method of the request, listing those they do take in the
+// Allow header.
+func methodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var allowed []string
+		for _, method := range allMethods {
+			var match mux.RouteMatch
+			other := req.Clone(req.Context())
+			other.Method = method
+			if router.Match(other, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		showErrorDetails(w, req, fmt.Sprintf("%s is not allowed on '%s'", req.Method, req.URL.Path),
+			405, "", map[string][]string{"allowed_methods": allowed})
+	})
+}
+
+// jsonErrors wraps h so that its plain text error responses, as written
+// by http.Error in bleve's handlers and the file server, become JSON
+// errors like the rest.
+func jsonErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ew := &errorWriter{ResponseWriter: w}
+		h.ServeHTTP(ew, req)
+		if ew.status != 0 {
+			msg := strings.TrimSpace(ew.body.String())
+			if msg == "" {
+				msg = http.StatusText(ew.status)
+			}
+			writeError(w, req, apiError{Status: ew.status, Message: msg})
+		}
+	})
+}
+
+// errorWriter holds back error responses that aren't JSON, for jsonErrors
+// to rewrite.
+type errorWriter struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (e *errorWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+func (e *errorWriter) WriteHeader(code int) {
+	if e.wroteHeader || code < 200 {
+		e.ResponseWriter.WriteHeader(code)
+		return
+	}
+	e.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(e.Header().Get("Content-Type"))
+	if code >= 400 && (mediaType == "" || mediaType == "text/plain") {
+		e.status = code
+		return
+	}
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *errorWriter) Write(p []byte) (int, error) {
+	if !e.wroteHeader {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.status != 0 {
+		return e.body.Write(p)
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+func (e *errorWriter) Flush() {
+	if e.status != 0 {
+		return
+	}
+	e.wroteHeader = true
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
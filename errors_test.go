@@ -0,0 +1,166 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/gorilla/mux"
+)
+
+func TestErrorCode(t *testing.T) {
+	for status, expected := range map[int]string{
+		400: "bad_request",
+		404: "not_found",
+		405: "method_not_allowed",
+		418: "im_a_teapot",
+		429: "too_many_requests",
+		504: "gateway_timeout",
+		599: "error",
+	} {
+		if code := errorCode(status); code != expected {
+			t.Errorf("%d: expected %s, got %s", status, expected, code)
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/plain", func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "no such document 'x'", 404)
+	})
+	router.HandleFunc("/empty", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(503)
+	})
+	router.HandleFunc("/ok", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("fine"))
+	})
+	router.HandleFunc("/api/search", func(w http.ResponseWriter, req *http.Request) {}).Methods("GET", "POST")
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = methodNotAllowed(router)
+	h := jsonErrors(router)
+
+	do := func(method, path string) (*httptest.ResponseRecorder, apiError) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var e apiError
+		if rec.Code >= 400 {
+			if rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("%s %s: expected JSON, got %s", method, path, rec.Header().Get("Content-Type"))
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+				t.Errorf("%s %s: %v: %s", method, path, err, rec.Body)
+			}
+		}
+		return rec, e
+	}
+
+	tests := []struct {
+		method, path string
+		status       int
+		code         string
+		message      string
+	}{
+		{"GET", "/plain", 404, "not_found", "no such document 'x'"},
+		{"GET", "/empty", 503, "service_unavailable", "Service Unavailable"},
+		{"GET", "/nowhere", 404, "not_found", "no such endpoint '/nowhere'"},
+		{"DELETE", "/api/search", 405, "method_not_allowed", "DELETE is not allowed on '/api/search'"},
+	}
+	for _, test := range tests {
+		rec, e := do(test.method, test.path)
+		if rec.Code != test.status || e.Status != test.status || e.Code != test.code || e.Message != test.message {
+			t.Errorf("%s %s: expected %d %s %q, got %d %+v", test.method, test.path, test.status, test.code, test.message, rec.Code, e)
+		}
+	}
+
+	rec, _ := do("DELETE", "/api/search")
+	if allow := rec.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("expected GET and POST to be allowed, got %q", allow)
+	}
+	if rec, _ := do("GET", "/ok"); rec.Code != 200 || rec.Body.String() != "fine" {
+		t.Errorf("expected other responses to pass through, got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestInvalidQueryErrors(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 10)
+	bleveHttp.RegisterIndexName("beer-errors-test", index)
+	defer bleveHttp.UnregisterIndexByName("beer-errors-test")
+	handler := newSearchHandler("beer-errors-test", time.Minute, nil)
+
+	search := func(body string) (int, apiError) {
+		req := httptest.NewRequest("POST", "/api/search", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var e apiError
+		json.Unmarshal(rec.Body.Bytes(), &e)
+		return rec.Code, e
+	}
+	for _, body := range []string{
+		`{"query": {"query": "abv:>"}}`,
+		`{"query": {"regexp": "[a", "field": "name"}}`,
+		`{"query": {"match": "ale", "fuzziness": 10}}`,
+		`{"query": {"query": "name:ale~3"}}`,
+		`{"query": {"start": "not a date", "field": "updated"}}`,
+		`{"query": {"conjuncts": [{"match_all": {}}, {"end": "nor this", "field": "updated"}]}}`,
+		`{"query": `,
+	} {
+		if code, e := search(body); code != 400 || e.Code != codeInvalidQuery {
+			t.Errorf("%s: expected 400 invalid_query, got %d %+v", body, code, e)
+		}
+	}
+
+	// while dates that parse and fuzziness in range are fine
+	for _, body := range []string{
+		`{"query": {"start": "2010-07-22 20:00:20", "field": "updated"}}`,
+		`{"query": {"query": "name:ale~2"}}`,
+	} {
+		if code, e := search(body); code != 200 {
+			t.Errorf("%s: expected 200, got %d %+v", body, code, e)
+		}
+	}
+
+	// a query string syntax error says where it is
+	_, e := search(`{"query": {"query": "abv:>"}}`)
+	details, _ := e.Details.(map[string]interface{})
+	if details == nil || details["position"] != 5.0 {
+		t.Errorf("expected the position of the syntax error, got %+v", e)
+	}
+
+	// other errors from running a search are the server's, whatever
+	// they say
+	for _, err := range []error{
+		errors.New("disk on fire"),
+		errors.New("syntax error in segment file"),
+		errors.New("could not parse footer"),
+	} {
+		if isInvalidQuery(fmt.Errorf("error executing query: %w", err)) {
+			t.Errorf("expected %q not to be the query's fault", err)
+		}
+	}
+}
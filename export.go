@@ -0,0 +1,261 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+// exportPageSize is how many hits an export fetches at a time, which
+// bounds its memory use.
+const exportPageSize = 500
+
+// exportHandler streams every hit of a search as CSV or NDJSON. It takes
+// the same request as searchHandler, but ignores size and from: it pages
+// through all matches with search_after, writing each page as it comes.
+//
+// The format parameter is csv or ndjson (the default), and columns is a
+// comma separated list of the stored fields to write, where _id and
+// _score are the document ID and score. Without columns, CSV has the ID
+// and every field in the index, and NDJSON every stored field.
+type exportHandler struct {
+	defaultIndexName string
+	pageTimeout      time.Duration
+	pageSize         int
+}
+
+func newExportHandler(defaultIndexName string, pageTimeout time.Duration) *exportHandler {
+	return &exportHandler{
+		defaultIndexName: defaultIndexName,
+		pageTimeout:      pageTimeout,
+		pageSize:         exportPageSize,
+	}
+}
+
+// exportWriter writes one format of export.
+type exportWriter interface {
+	writeHit(hit *search.DocumentMatch) error
+	flush() error
+}
+
+func (h *exportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	index := bleveHttp.IndexByName(h.defaultIndexName)
+	if index == nil {
+		showError(w, req, fmt.Sprintf("no such index '%s'", h.defaultIndexName), 404)
+		return
+	}
+
+	searchRequest, err := parseSearchRequest(req, index.Mapping())
+	if err != nil {
+		showQueryError(w, req, err, 400)
+		return
+	}
+
+	var columns []string
+	if columnsStr := req.FormValue("columns"); columnsStr != "" {
+		columns = strings.Split(columnsStr, ",")
+	}
+
+	format := req.FormValue("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	var out exportWriter
+	switch format {
+	case "csv":
+		if columns == nil {
+			columns, err = exportColumns(index)
+			if err != nil {
+				showError(w, req, fmt.Sprintf("error listing fields: %v", err), 500)
+				return
+			}
+		}
+		w.Header().Set("Content-type", "text/csv; charset=utf-8")
+		out, err = newCSVExport(w, columns)
+	case "ndjson":
+		w.Header().Set("Content-type", "application/x-ndjson")
+		out = &ndjsonExport{enc: json.NewEncoder(w), columns: columns}
+	default:
+		showError(w, req, fmt.Sprintf("unknown export format '%s'", format), 400)
+		return
+	}
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error writing export: %v", err), 500)
+		return
+	}
+
+	searchRequest.Size = h.pageSize
+	searchRequest.From = 0
+	searchRequest.Fields = []string{"*"}
+	if columns != nil {
+		searchRequest.Fields = columns
+	}
+	searchRequest.Facets = nil
+	searchRequest.Highlight = nil
+	stableSort(searchRequest)
+
+	info := requestInfoFrom(req.Context())
+	info.noteQuery(searchRequest.Query)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, h.defaultIndexName, format))
+	count, err := h.export(req.Context(), index, searchRequest, out, w)
+	info.noteHits(uint64(count))
+	if err != nil {
+		// the response has started, so all that can be done is to stop
+		// short of the end
+		log.Printf("Export stopped after %d hits: %v", count, err)
+	}
+}
+
+// export writes every page of searchRequest to out, flushing each one to
+// w if it is an http.Flusher, and returns how many hits it wrote.
+func (h *exportHandler) export(ctx context.Context, index bleve.Index, searchRequest *bleve.SearchRequest, out exportWriter, w io.Writer) (int, error) {
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	for {
+		searchResponse, _, err := runSearch(ctx, index, searchRequest, h.pageTimeout)
+		if err != nil {
+			return count, err
+		}
+		if searchResponse.Status.Failed > 0 {
+			// skipping a failed shard's hits would silently lose rows
+			return count, errors.New("some shards failed")
+		}
+		for _, hit := range searchResponse.Hits {
+			if err := out.writeHit(hit); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err := out.flush(); err != nil {
+			return count, err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(searchResponse.Hits) < searchRequest.Size {
+			return count, nil
+		}
+		searchRequest.SearchAfter = searchAfter(searchRequest, searchResponse.Hits[len(searchResponse.Hits)-1])
+	}
+}
+
+// exportColumns returns the default CSV columns for index: the document
+// ID, then every field in alphabetical order.
+func exportColumns(index bleve.Index) ([]string, error) {
+	fields, err := index.Fields()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fields)
+	columns := []string{"_id"}
+	for _, field := range fields {
+		if field != "_all" && field != "_id" {
+			columns = append(columns, field)
+		}
+	}
+	return columns, nil
+}
+
+// exportValue returns a column of hit: the ID, score or a stored field.
+func exportValue(hit *search.DocumentMatch, column string) interface{} {
+	switch column {
+	case "_id":
+		return hit.ID
+	case "_score":
+		return hit.Score
+	}
+	return hit.Fields[column]
+}
+
+type csvExport struct {
+	w       *csv.Writer
+	columns []string
+	record  []string
+}
+
+func newCSVExport(w io.Writer, columns []string) (*csvExport, error) {
+	rv := &csvExport{
+		w:       csv.NewWriter(w),
+		columns: columns,
+		record:  make([]string, len(columns)),
+	}
+	return rv, rv.w.Write(columns)
+}
+
+func (c *csvExport) writeHit(hit *search.DocumentMatch) error {
+	for n, column := range c.columns {
+		c.record[n] = csvValue(exportValue(hit, column))
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvExport) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// csvValue formats a stored field for CSV. Fields with several values
+// are joined with semicolons.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		values := make([]string, len(v))
+		for n, value := range v {
+			values[n] = csvValue(value)
+		}
+		return strings.Join(values, ";")
+	}
+	return fmt.Sprint(v)
+}
+
+type ndjsonExport struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func (n *ndjsonExport) writeHit(hit *search.DocumentMatch) error {
+	row := map[string]interface{}{}
+	if n.columns == nil {
+		row["_id"] = hit.ID
+		for field, value := range hit.Fields {
+			row[field] = value
+		}
+	} else {
+		for _, column := range n.columns {
+			row[column] = exportValue(hit, column)
+		}
+	}
+	return n.enc.Encode(row)
+}
+
+func (n *ndjsonExport) flush() error {
+	return nil
+}
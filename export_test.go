@@ -0,0 +1,103 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+func TestExport(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 300)
+
+	bleveHttp.RegisterIndexName("beer-export-test", index)
+	defer bleveHttp.UnregisterIndexByName("beer-export-test")
+	handler := newExportHandler("beer-export-test", time.Minute)
+	// small pages, so the export needs many of them
+	handler.pageSize = 7
+
+	total, err := index.Search(bleve.NewSearchRequest(bleve.NewQueryStringQuery("+type:beer +abv:>5")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"query": {"query": "+type:beer +abv:>5"}, "size": 3}`
+
+	// CSV, with the columns asked for
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/export?format=csv&columns=_id,name,abv", strings.NewReader(body)))
+	if rec.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(records[0], ",") != "_id,name,abv" {
+		t.Errorf("expected header _id,name,abv, got %v", records[0])
+	}
+	ids := map[string]bool{}
+	for _, record := range records[1:] {
+		if ids[record[0]] {
+			t.Errorf("%s exported twice", record[0])
+		}
+		ids[record[0]] = true
+		if record[1] == "" || record[2] == "" {
+			t.Errorf("expected name and abv for %s, got %v", record[0], record)
+		}
+	}
+	if uint64(len(ids)) != total.Total {
+		t.Errorf("expected %d rows, got %d", total.Total, len(ids))
+	}
+
+	// NDJSON, with every stored field
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/export?q=%2Btype:beer+%2Babv:>5", nil))
+	if rec.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	rows := 0
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		if !ids[row["_id"].(string)] || row["name"] == nil {
+			t.Errorf("unexpected row %v", row)
+		}
+		rows++
+	}
+	if rows != len(ids) {
+		t.Errorf("expected %d rows, got %d", len(ids), rows)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/export?format=parquet", nil))
+	if rec.Code != 400 {
+		t.Errorf("expected 400 for unknown format, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,311 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/blevesearch/bleve/v2/numeric"
+	index "github.com/blevesearch/bleve_index_api"
+)
+
+const maxFieldTerms = 1000
+
+func fieldLookup(req *http.Request) string {
+	return muxVariableLookup(req, "field")
+}
+
+// positiveIntParam returns the named request parameter, which must be
+// between 1 and max, or def if it is missing.
+func positiveIntParam(req *http.Request, name string, def, max int) (int, error) {
+	s := req.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 1 || i > max {
+		return 0, fmt.Errorf("%s must be a number from 1 to %d", name, max)
+	}
+	return i, nil
+}
+
+type fieldTerm struct {
+	Term  string `json:"term"`
+	Count uint64 `json:"count"`
+}
+
+// fieldTermsHandler lists the terms of a field, in order, with the
+// number of documents each is found in, like the list of fields from
+// bleve's ListFieldsHandler. The prefix parameter restricts them to terms
+// starting with it, and limit (default 100) says how many to return.
+type fieldTermsHandler struct {
+	defaultIndexName string
+}
+
+func newFieldTermsHandler(defaultIndexName string) *fieldTermsHandler {
+	return &fieldTermsHandler{
+		defaultIndexName: defaultIndexName,
+	}
+}
+
+func (h *fieldTermsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	idx := bleveHttp.IndexByName(h.defaultIndexName)
+	if idx == nil {
+		showError(w, req, fmt.Sprintf("no such index '%s'", h.defaultIndexName), 404)
+		return
+	}
+
+	field := fieldLookup(req)
+	prefix := req.FormValue("prefix")
+	limit, err := positiveIntParam(req, "limit", 100, maxFieldTerms)
+	if err != nil {
+		showError(w, req, err.Error(), 400)
+		return
+	}
+
+	terms, more, err := fieldTerms(idx, field, []byte(prefix), limit)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error reading terms: %v", err), 500)
+		return
+	}
+
+	rv := struct {
+		Field string      `json:"field"`
+		Terms []fieldTerm `json:"terms"`
+		More  bool        `json:"more"`
+	}{
+		Field: field,
+		Terms: terms,
+		More:  more,
+	}
+	mustEncode(w, rv)
+}
+
+// fieldTerms returns up to limit terms of field starting with prefix,
+// and whether there are more.
+func fieldTerms(i bleve.Index, field string, prefix []byte, limit int) ([]fieldTerm, bool, error) {
+	terms := []fieldTerm{}
+	more := false
+	err := walkFieldDict(i, field, prefix, func(term string) bool {
+		if len(terms) == limit {
+			more = true
+			return false
+		}
+		terms = append(terms, fieldTerm{Term: term})
+		return true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	for n := range terms {
+		terms[n].Count, err = termDocCount(i, field, terms[n].Term)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return terms, more, nil
+}
+
+// walkFieldDict calls f with each term of field starting with prefix,
+// until it returns false.
+func walkFieldDict(i bleve.Index, field string, prefix []byte, f func(term string) bool) error {
+	var dict index.FieldDict
+	var err error
+	if len(prefix) > 0 {
+		dict, err = i.FieldDictPrefix(field, prefix)
+	} else {
+		dict, err = i.FieldDict(field)
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			dict.Close()
+			return err
+		}
+		if entry == nil || !f(entry.Term) {
+			break
+		}
+	}
+	return dict.Close()
+}
+
+// termDocCount returns the number of documents with term in field. The
+// counts read while walking a term dictionary can't be used for this:
+// zap's dictionary iterator reports at most 1 for a term read after one
+// with a single hit. So the count is read from a dictionary of just the
+// one term, which doesn't go through its postings as a search would.
+func termDocCount(i bleve.Index, field, term string) (uint64, error) {
+	dict, err := i.FieldDictRange(field, []byte(term), []byte(term))
+	if err != nil {
+		return 0, err
+	}
+	var count uint64
+	entry, err := dict.Next()
+	if err != nil {
+		dict.Close()
+		return 0, err
+	}
+	if entry != nil && entry.Term == term {
+		count = entry.Count
+	}
+	return count, dict.Close()
+}
+
+type histogramBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count uint64  `json:"count"`
+}
+
+type fieldStats struct {
+	Field     string            `json:"field"`
+	Count     uint64            `json:"count"`
+	Distinct  int               `json:"distinct"`
+	Min       float64           `json:"min"`
+	Max       float64           `json:"max"`
+	Mean      float64           `json:"mean"`
+	Histogram []histogramBucket `json:"histogram"`
+}
+
+// fieldStatsHandler summarizes the values of a numeric field: how many
+// there are, the smallest, largest and mean, and a histogram with the
+// buckets parameter (default 10) equal width buckets. A document with
+// several values is counted once for each.
+type fieldStatsHandler struct {
+	defaultIndexName string
+}
+
+func newFieldStatsHandler(defaultIndexName string) *fieldStatsHandler {
+	return &fieldStatsHandler{
+		defaultIndexName: defaultIndexName,
+	}
+}
+
+func (h *fieldStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	idx := bleveHttp.IndexByName(h.defaultIndexName)
+	if idx == nil {
+		showError(w, req, fmt.Sprintf("no such index '%s'", h.defaultIndexName), 404)
+		return
+	}
+
+	field := fieldLookup(req)
+	buckets, err := positiveIntParam(req, "buckets", 10, 1000)
+	if err != nil {
+		showError(w, req, err.Error(), 400)
+		return
+	}
+
+	stats, err := numericFieldStats(idx, field, buckets)
+	if errors.Is(err, errNotNumeric) {
+		showError(w, req, err.Error(), 400)
+		return
+	} else if err != nil {
+		showError(w, req, fmt.Sprintf("error reading terms: %v", err), 500)
+		return
+	}
+	mustEncode(w, stats)
+}
+
+var errNotNumeric = errors.New("no numeric values")
+
+// maxFieldValues is the most distinct values a field may have for its
+// stats to be computed.
+const maxFieldValues = 10000
+
+// numericFieldStats computes the stats of field from the distinct values
+// in its term dictionary.
+func numericFieldStats(i bleve.Index, field string, buckets int) (*fieldStats, error) {
+	values, err := numericFieldValues(i, field)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("field '%s' has %w", field, errNotNumeric)
+	}
+
+	rv := &fieldStats{
+		Field:    field,
+		Distinct: len(values),
+		Min:      values[0].value,
+		Max:      values[len(values)-1].value,
+	}
+	if rv.Min == rv.Max {
+		buckets = 1
+	}
+	width := (rv.Max - rv.Min) / float64(buckets)
+	rv.Histogram = make([]histogramBucket, buckets)
+	for n := range rv.Histogram {
+		rv.Histogram[n].Min = rv.Min + float64(n)*width
+		rv.Histogram[n].Max = rv.Min + float64(n+1)*width
+	}
+	rv.Histogram[buckets-1].Max = rv.Max
+
+	var sum float64
+	for _, v := range values {
+		count, err := termDocCount(i, field, v.term)
+		if err != nil {
+			return nil, err
+		}
+		rv.Count += count
+		sum += v.value * float64(count)
+
+		n := buckets - 1
+		if width > 0 && v.value < rv.Max {
+			n = int((v.value - rv.Min) / width)
+			if n >= buckets {
+				n = buckets - 1
+			}
+		}
+		rv.Histogram[n].Count += count
+	}
+	if rv.Count > 0 {
+		rv.Mean = sum / float64(rv.Count)
+	}
+	return rv, nil
+}
+
+type numericFieldValue struct {
+	term  string
+	value float64
+}
+
+// numericFieldValues returns the distinct values of a numeric field, in
+// order. Numbers are indexed as several terms of decreasing precision,
+// of which only the full precision ones, with no shift, are read.
+func numericFieldValues(i bleve.Index, field string) ([]numericFieldValue, error) {
+	var rv []numericFieldValue
+	var walkErr error
+	err := walkFieldDict(i, field, []byte{numeric.ShiftStartInt64}, func(term string) bool {
+		i64, err := numeric.PrefixCoded(term).Int64()
+		if valid, shift := numeric.ValidPrefixCodedTerm(term); !valid || shift != 0 || err != nil {
+			walkErr = fmt.Errorf("field '%s' has %w", field, errNotNumeric)
+			return false
+		}
+		if len(rv) == maxFieldValues {
+			walkErr = fmt.Errorf("field '%s' has more than %d distinct values", field, maxFieldValues)
+			return false
+		}
+		rv = append(rv, numericFieldValue{term: term, value: numeric.Int64ToFloat64(i64)})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, walkErr
+}
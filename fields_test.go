@@ -0,0 +1,151 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/gorilla/mux"
+)
+
+func TestFieldTermsAndStats(t *testing.T) {
+	useTestData(t, 300)
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same documents in one index on disk, and spread over three
+	// shards in memory
+	single, err := newIndex(filepath.Join(t.TempDir(), "beer.bleve"), mapping, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	var shards []bleve.Index
+	for n := 0; n < 3; n++ {
+		shard, err := bleve.NewMemOnly(mapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, shard)
+	}
+	sharded := newShardedIndex(shards)
+	defer sharded.Close()
+	for _, idx := range []bleve.Index{single, sharded} {
+		if _, err := indexBeer(context.Background(), idx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(indexName, url string) (int, []byte) {
+		router := mux.NewRouter()
+		router.Handle("/api/fields/{field}/terms", newFieldTermsHandler(indexName))
+		router.Handle("/api/fields/{field}/stats", newFieldStatsHandler(indexName))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return rec.Code, rec.Body.Bytes()
+	}
+
+	bleveHttp.RegisterIndexName("beer-fields-single", single)
+	defer bleveHttp.UnregisterIndexByName("beer-fields-single")
+	bleveHttp.RegisterIndexName("beer-fields-sharded", sharded)
+	defer bleveHttp.UnregisterIndexByName("beer-fields-sharded")
+
+	type termsResult struct {
+		Terms []fieldTerm `json:"terms"`
+		More  bool        `json:"more"`
+	}
+	var results []termsResult
+	for _, name := range []string{"beer-fields-single", "beer-fields-sharded"} {
+		code, body := get(name, "/api/fields/style/terms?prefix=American&limit=5")
+		if code != 200 {
+			t.Fatalf("%s: expected 200, got %d: %s", name, code, body)
+		}
+		var result termsResult
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Terms) != 5 || !result.More {
+			t.Errorf("%s: expected 5 terms and more, got %d and %v", name, len(result.Terms), result.More)
+		}
+		for n, term := range result.Terms {
+			if n > 0 && term.Term <= result.Terms[n-1].Term {
+				t.Errorf("%s: terms out of order at %+v", name, term)
+			}
+			q := bleve.NewTermQuery(term.Term)
+			q.SetField("style")
+			withTerm, err := single.Search(bleve.NewSearchRequestOptions(q, 0, 0, false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if term.Count == 0 || term.Count != withTerm.Total {
+				t.Errorf("%s: expected %d documents with %+v", name, withTerm.Total, term)
+			}
+		}
+		results = append(results, result)
+	}
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("expected the same terms from one index and three shards, got %+v and %+v", results[0], results[1])
+	}
+
+	var stats []fieldStats
+	for _, name := range []string{"beer-fields-single", "beer-fields-sharded"} {
+		code, body := get(name, "/api/fields/abv/stats?buckets=4")
+		if code != 200 {
+			t.Fatalf("%s: expected 200, got %d: %s", name, code, body)
+		}
+		var result fieldStats
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Count == 0 || result.Min > result.Mean || result.Mean > result.Max || len(result.Histogram) != 4 {
+			t.Errorf("%s: unexpected stats %+v", name, result)
+		}
+		min := 0.0
+		q := bleve.NewNumericRangeQuery(&min, nil)
+		q.SetField("abv")
+		withABV, err := single.Search(bleve.NewSearchRequestOptions(q, 0, 0, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Count != withABV.Total {
+			t.Errorf("%s: expected a value for each of %d documents, got %d", name, withABV.Total, result.Count)
+		}
+		var total uint64
+		for _, bucket := range result.Histogram {
+			total += bucket.Count
+		}
+		if total != result.Count {
+			t.Errorf("%s: expected histogram to hold %d values, got %d", name, result.Count, total)
+		}
+		stats = append(stats, result)
+	}
+	if !reflect.DeepEqual(stats[0], stats[1]) {
+		t.Errorf("expected the same stats from one index and three shards, got %+v and %+v", stats[0], stats[1])
+	}
+
+	for _, url := range []string{
+		"/api/fields/name/stats",
+		"/api/fields/abv/stats?buckets=0",
+		"/api/fields/style/terms?limit=lots",
+	} {
+		if code, _ := get("beer-fields-single", url); code != 400 {
+			t.Errorf("%s: expected 400, got %d", url, code)
+		}
+	}
+}
@@ -0,0 +1,800 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+var graphqlMaxCost = flag.Int("graphqlMaxCost", 1000, "most a GraphQL query may cost: one per field, times the sizes of the lists it is in")
+
+// graphqlDefaultSize is the number of hits, or of a brewery's beers, a
+// GraphQL query gets when it doesn't give a size.
+const graphqlDefaultSize = 10
+
+// graphqlDoc is a beer or brewery: its ID and stored fields, as loaded
+// from the index, and its score if it came from a search.
+type graphqlDoc struct {
+	id     string
+	score  float64
+	fields map[string]interface{}
+}
+
+func (d *graphqlDoc) docType() string {
+	s, _ := d.fields["type"].(string)
+	return s
+}
+
+// graphqlBreweryBeers are the arguments of a brewery's beers lookup.
+type graphqlBreweryBeers struct {
+	breweryID string
+	size      int
+	sort      string
+}
+
+// graphqlLoader looks up documents for the resolvers of one GraphQL
+// request. Lookups are queued, and resolvers return thunks, which the
+// executor calls once every resolver at the same depth has run; the
+// first thunk runs all the queued lookups, so that the breweries of a
+// page of beers, or the beers of a page of breweries, are one search
+// rather than one each.
+type graphqlLoader struct {
+	index   bleve.Index
+	timeout time.Duration
+
+	mutex        sync.Mutex
+	pending      []string
+	pendingBeers []graphqlBreweryBeers
+	docs         map[string]*graphqlDoc
+	beers        map[graphqlBreweryBeers][]*graphqlDoc
+	batches      int
+}
+
+func newGraphQLLoader(index bleve.Index, timeout time.Duration) *graphqlLoader {
+	return &graphqlLoader{
+		index:   index,
+		timeout: timeout,
+		docs:    map[string]*graphqlDoc{},
+		beers:   map[graphqlBreweryBeers][]*graphqlDoc{},
+	}
+}
+
+type graphqlLoaderKey struct{}
+
+func graphqlLoaderFrom(ctx context.Context) *graphqlLoader {
+	l, _ := ctx.Value(graphqlLoaderKey{}).(*graphqlLoader)
+	return l
+}
+
+// prime records docs that a search has already loaded.
+func (l *graphqlLoader) prime(docs []*graphqlDoc) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, doc := range docs {
+		if _, ok := l.docs[doc.id]; !ok {
+			l.docs[doc.id] = doc
+		}
+	}
+}
+
+// load queues the lookup of the document id, and returns a thunk
+// returning it, or nil if there is no such document of type docType.
+func (l *graphqlLoader) load(ctx context.Context, id, docType string) func() (interface{}, error) {
+	l.mutex.Lock()
+	if _, ok := l.docs[id]; !ok {
+		l.pending = append(l.pending, id)
+	}
+	l.mutex.Unlock()
+
+	return func() (interface{}, error) {
+		if err := l.flush(ctx); err != nil {
+			return nil, err
+		}
+		l.mutex.Lock()
+		doc := l.docs[id]
+		l.mutex.Unlock()
+		if doc == nil || doc.docType() != docType {
+			return nil, nil
+		}
+		return doc, nil
+	}
+}
+
+// flush looks up every queued document with one search.
+func (l *graphqlLoader) flush(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var ids []string
+	for _, id := range l.pending {
+		if _, ok := l.docs[id]; !ok {
+			ids = append(ids, id)
+			// a missing document is only looked for once
+			l.docs[id] = nil
+		}
+	}
+	l.pending = nil
+	if len(ids) == 0 {
+		return nil
+	}
+
+	l.batches++
+	searchRequest := bleve.NewSearchRequestOptions(bleve.NewDocIDQuery(ids), len(ids), 0, false)
+	searchRequest.Fields = []string{"*"}
+	result, _, err := runSearch(ctx, l.index, searchRequest, l.timeout)
+	if err != nil {
+		return fmt.Errorf("error looking up documents: %v", err)
+	}
+	for _, doc := range graphqlDocs(result.Hits) {
+		l.docs[doc.id] = doc
+	}
+	return nil
+}
+
+// breweryBeers queues the lookup of a brewery's beers, and returns a
+// thunk returning them.
+func (l *graphqlLoader) breweryBeers(ctx context.Context, key graphqlBreweryBeers) func() (interface{}, error) {
+	l.mutex.Lock()
+	if _, ok := l.beers[key]; !ok {
+		l.pendingBeers = append(l.pendingBeers, key)
+	}
+	l.mutex.Unlock()
+
+	return func() (interface{}, error) {
+		if err := l.flushBeers(ctx); err != nil {
+			return nil, err
+		}
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return l.beers[key], nil
+	}
+}
+
+// flushBeers looks up the beers of every queued brewery, with one
+// search for each sort order.
+func (l *graphqlLoader) flushBeers(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bySort := map[string][]graphqlBreweryBeers{}
+	var sorts []string
+	for _, key := range l.pendingBeers {
+		if _, ok := l.beers[key]; ok {
+			continue
+		}
+		// a brewery is only looked up once
+		l.beers[key] = []*graphqlDoc{}
+		if bySort[key.sort] == nil {
+			sorts = append(sorts, key.sort)
+		}
+		bySort[key.sort] = append(bySort[key.sort], key)
+	}
+	l.pendingBeers = nil
+
+	for _, sort := range sorts {
+		if err := l.searchBeers(ctx, sort, bySort[sort]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchBeers looks up the beers of the breweries of keys, all sorted
+// by sort, and splits them by brewery. The caller holds l.mutex.
+func (l *graphqlLoader) searchBeers(ctx context.Context, sort string, keys []graphqlBreweryBeers) error {
+	sizes := map[string]int{}
+	breweryQuery := bleve.NewDisjunctionQuery()
+	for _, key := range keys {
+		if _, ok := sizes[key.breweryID]; !ok {
+			idQuery := bleve.NewTermQuery(key.breweryID)
+			idQuery.SetField("brewery_id")
+			breweryQuery.AddQuery(idQuery)
+		}
+		if key.size > sizes[key.breweryID] {
+			sizes[key.breweryID] = key.size
+		}
+	}
+	size := 0
+	for _, n := range sizes {
+		size += n
+	}
+	if size == 0 {
+		return nil
+	}
+	typeQuery := bleve.NewTermQuery("beer")
+	typeQuery.SetField("type")
+
+	var beers map[string][]*graphqlDoc
+	for {
+		l.batches++
+		searchRequest := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(breweryQuery, typeQuery), size, 0, false)
+		searchRequest.Fields = []string{"*"}
+		if sort != "" {
+			searchRequest.SortBy(strings.Split(sort, ","))
+		}
+		result, _, err := runSearch(ctx, l.index, searchRequest, l.timeout)
+		if err != nil {
+			return fmt.Errorf("error searching beers: %v", err)
+		}
+		beers = map[string][]*graphqlDoc{}
+		short := false
+		for _, doc := range graphqlDocs(result.Hits) {
+			id, _ := doc.fields["brewery_id"].(string)
+			beers[id] = append(beers[id], doc)
+		}
+		for id, n := range sizes {
+			short = short || len(beers[id]) < n
+		}
+		// the strongest beers of one brewery can crowd out another's,
+		// so a short page is looked up again with every beer
+		if !short || uint64(len(result.Hits)) >= result.Total {
+			break
+		}
+		size = int(result.Total)
+	}
+
+	for _, key := range keys {
+		docs := beers[key.breweryID]
+		if len(docs) > key.size {
+			docs = docs[:key.size]
+		}
+		if docs == nil {
+			docs = []*graphqlDoc{}
+		}
+		l.beers[key] = docs
+		for _, doc := range docs {
+			if _, ok := l.docs[doc.id]; !ok {
+				l.docs[doc.id] = doc
+			}
+		}
+	}
+	return nil
+}
+
+func graphqlDocs(hits search.DocumentMatchCollection) []*graphqlDoc {
+	docs := make([]*graphqlDoc, 0, len(hits))
+	for _, hit := range hits {
+		docs = append(docs, &graphqlDoc{id: hit.ID, score: hit.Score, fields: hit.Fields})
+	}
+	return docs
+}
+
+// graphqlField resolves a field of a graphqlDoc to its stored field
+// name.
+func graphqlField(name string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		doc, ok := p.Source.(*graphqlDoc)
+		if !ok {
+			return nil, nil
+		}
+		return doc.fields[name], nil
+	}
+}
+
+// graphqlListField resolves a field of a graphqlDoc that may have
+// several values, which has one value stored as itself.
+func graphqlListField(name string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		doc, ok := p.Source.(*graphqlDoc)
+		if !ok {
+			return nil, nil
+		}
+		switch v := doc.fields[name].(type) {
+		case nil:
+			return []interface{}{}, nil
+		case []interface{}:
+			return v, nil
+		default:
+			return []interface{}{v}, nil
+		}
+	}
+}
+
+func graphqlID(p graphql.ResolveParams) (interface{}, error) {
+	return p.Source.(*graphqlDoc).id, nil
+}
+
+// newGraphQLSchema returns the schema of the GraphQL API. Searches use
+// the same parameters as GET /api/search.
+func newGraphQLSchema() (graphql.Schema, error) {
+	breweryType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Brewery",
+		Description: "A brewery",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: graphqlID},
+			"name":        &graphql.Field{Type: graphql.String, Resolve: graphqlField("name")},
+			"description": &graphql.Field{Type: graphql.String, Resolve: graphqlField("description")},
+			"address":     &graphql.Field{Type: graphql.NewList(graphql.String), Resolve: graphqlListField("address")},
+			"city":        &graphql.Field{Type: graphql.String, Resolve: graphqlField("city")},
+			"state":       &graphql.Field{Type: graphql.String, Resolve: graphqlField("state")},
+			"code":        &graphql.Field{Type: graphql.String, Resolve: graphqlField("code")},
+			"country":     &graphql.Field{Type: graphql.String, Resolve: graphqlField("country")},
+			"phone":       &graphql.Field{Type: graphql.String, Resolve: graphqlField("phone")},
+			"website":     &graphql.Field{Type: graphql.String, Resolve: graphqlField("website")},
+			"lat":         &graphql.Field{Type: graphql.Float, Resolve: graphqlField("geo.lat")},
+			"lon":         &graphql.Field{Type: graphql.Float, Resolve: graphqlField("geo.lon")},
+			"updated":     &graphql.Field{Type: graphql.String, Resolve: graphqlField("updated")},
+		},
+	})
+
+	beerType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Beer",
+		Description: "A beer",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: graphqlID},
+			"name":        &graphql.Field{Type: graphql.String, Resolve: graphqlField("name")},
+			"description": &graphql.Field{Type: graphql.String, Resolve: graphqlField("description")},
+			"style":       &graphql.Field{Type: graphql.String, Resolve: graphqlField("style")},
+			"category":    &graphql.Field{Type: graphql.String, Resolve: graphqlField("category")},
+			"abv":         &graphql.Field{Type: graphql.Float, Resolve: graphqlField("abv")},
+			"ibu":         &graphql.Field{Type: graphql.Float, Resolve: graphqlField("ibu")},
+			"srm":         &graphql.Field{Type: graphql.Float, Resolve: graphqlField("srm")},
+			"upc":         &graphql.Field{Type: graphql.Float, Resolve: graphqlField("upc")},
+			"updated":     &graphql.Field{Type: graphql.String, Resolve: graphqlField("updated")},
+			"breweryId":   &graphql.Field{Type: graphql.ID, Resolve: graphqlField("brewery_id")},
+			"brewery": &graphql.Field{
+				Type:        breweryType,
+				Description: "The brewery of the beer, looked up with those of the other beers in the result",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, _ := p.Source.(*graphqlDoc).fields["brewery_id"].(string)
+					if id == "" {
+						return nil, nil
+					}
+					return graphqlLoaderFrom(p.Context).load(p.Context, id, "brewery"), nil
+				},
+			},
+		},
+	})
+
+	// a brewery's beers refer back to the beer type
+	breweryType.AddFieldConfig("beers", &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(beerType))),
+		Description: "The beers of the brewery, by default the strongest first",
+		Args: graphql.FieldConfigArgument{
+			"size": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlDefaultSize},
+			"sort": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "-abv", Description: "comma separated fields, - prefixed for descending"},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			size, _ := p.Args["size"].(int)
+			if size < 0 {
+				return nil, fmt.Errorf("size must not be negative")
+			}
+			sort, _ := p.Args["sort"].(string)
+			key := graphqlBreweryBeers{breweryID: p.Source.(*graphqlDoc).id, size: size, sort: sort}
+			return graphqlLoaderFrom(p.Context).breweryBeers(p.Context, key), nil
+		},
+	})
+
+	documentType := graphql.NewUnion(graphql.UnionConfig{
+		Name:        "Document",
+		Description: "A beer or a brewery",
+		Types:       []*graphql.Object{beerType, breweryType},
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			if doc, ok := p.Value.(*graphqlDoc); ok && doc.docType() == "brewery" {
+				return breweryType
+			}
+			return beerType
+		},
+	})
+
+	hitType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Hit",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: graphqlID},
+			"score": &graphql.Field{Type: graphql.NewNonNull(graphql.Float), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*graphqlDoc).score, nil
+			}},
+			"document": &graphql.Field{Type: documentType, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source, nil
+			}},
+		},
+	})
+
+	facetTermType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "FacetTerm",
+		Fields: graphql.Fields{
+			"term":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"count": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	facetType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Facet",
+		Description: "The most common terms of a field among the hits",
+		Fields: graphql.Fields{
+			"field":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"total":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"missing": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"other":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"terms":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(facetTermType)))},
+		},
+	})
+
+	searchResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "SearchResult",
+		Fields: graphql.Fields{
+			"total":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"maxScore": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"took":     &graphql.Field{Type: graphql.NewNonNull(graphql.Float), Description: "milliseconds"},
+			"hits":     &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(hitType)))},
+			"facets":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(facetType)))},
+		},
+	})
+
+	idArgs := graphql.FieldConfigArgument{
+		"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+	}
+	stringList := graphql.NewList(graphql.NewNonNull(graphql.String))
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"beer": &graphql.Field{
+				Type: beerType,
+				Args: idArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlLoaderFrom(p.Context).load(p.Context, p.Args["id"].(string), "beer"), nil
+				},
+			},
+			"brewery": &graphql.Field{
+				Type: breweryType,
+				Args: idArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlLoaderFrom(p.Context).load(p.Context, p.Args["id"].(string), "brewery"), nil
+				},
+			},
+			"search": &graphql.Field{
+				Type:        graphql.NewNonNull(searchResultType),
+				Description: "Search beers and breweries, as GET /api/search does",
+				Args: graphql.FieldConfigArgument{
+					"query":  &graphql.ArgumentConfig{Type: graphql.String, Description: "query string syntax query; everything if empty"},
+					"filter": &graphql.ArgumentConfig{Type: stringList, Description: "field:value that hits must match"},
+					"size":   &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlDefaultSize},
+					"from":   &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+					"sort":   &graphql.ArgumentConfig{Type: stringList, Description: "fields to sort by, - prefixed for descending"},
+					"facets": &graphql.ArgumentConfig{Type: stringList, Description: "fields to facet on, or field:size"},
+				},
+				Resolve: graphqlSearch,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query: queryType,
+		Types: []graphql.Type{beerType, breweryType},
+	})
+}
+
+// graphqlSearch resolves a search, with the parameters of GET
+// /api/search.
+func graphqlSearch(p graphql.ResolveParams) (interface{}, error) {
+	params := url.Values{}
+	if q, _ := p.Args["query"].(string); q != "" {
+		params.Set("q", q)
+	}
+	for _, name := range []string{"size", "from"} {
+		if n, ok := p.Args[name].(int); ok {
+			params.Set(name, strconv.Itoa(n))
+		}
+	}
+	for arg, param := range map[string]string{"filter": "filter", "facets": "facet"} {
+		list, _ := p.Args[arg].([]interface{})
+		for _, v := range list {
+			params.Add(param, v.(string))
+		}
+	}
+	if list, _ := p.Args["sort"].([]interface{}); len(list) > 0 {
+		fields := make([]string, len(list))
+		for n, v := range list {
+			fields[n] = v.(string)
+		}
+		params.Set("sort", strings.Join(fields, ","))
+	}
+	searchRequest, err := searchRequestFromURL(params)
+	if err != nil {
+		return nil, err
+	}
+	if q, ok := searchRequest.Query.(query.ValidatableQuery); ok {
+		if err := q.Validate(); err != nil {
+			return nil, fmt.Errorf("error validating query: %v", err)
+		}
+	}
+	l := graphqlLoaderFrom(p.Context)
+	if err := checkQuery(searchRequest.Query, l.index.Mapping()); err != nil {
+		return nil, fmt.Errorf("error validating query: %v", err)
+	}
+	searchRequest.Fields = []string{"*"}
+
+	result, _, err := runSearch(p.Context, l.index, searchRequest, l.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	hits := graphqlDocs(result.Hits)
+	l.prime(hits)
+
+	facets := []map[string]interface{}{}
+	names := make([]string, 0, len(result.Facets))
+	for name := range result.Facets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		facet := result.Facets[name]
+		terms := []map[string]interface{}{}
+		if facet.Terms != nil {
+			for _, term := range facet.Terms.Terms() {
+				terms = append(terms, map[string]interface{}{"term": term.Term, "count": term.Count})
+			}
+		}
+		facets = append(facets, map[string]interface{}{
+			"field":   facet.Field,
+			"total":   facet.Total,
+			"missing": facet.Missing,
+			"other":   facet.Other,
+			"terms":   terms,
+		})
+	}
+
+	return map[string]interface{}{
+		"total":    int(result.Total),
+		"maxScore": result.MaxScore,
+		"took":     float64(result.Took) / float64(time.Millisecond),
+		"hits":     hits,
+		"facets":   facets,
+	}, nil
+}
+
+// graphqlCost returns what the operation of doc costs to run: one for
+// each field, times the sizes of the lists it is in, so that nesting
+// breweries' beers in a page of hits costs what the lookups would.
+func graphqlCost(doc *ast.Document, operationName string, variables map[string]interface{}) int {
+	var operation *ast.OperationDefinition
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.OperationDefinition:
+			if operationName == "" || (def.Name != nil && def.Name.Value == operationName) {
+				operation = def
+			}
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		}
+	}
+	if operation == nil {
+		return 0
+	}
+
+	defaults := map[string]interface{}{}
+	for _, def := range operation.VariableDefinitions {
+		if v, ok := def.DefaultValue.(*ast.IntValue); ok {
+			defaults[def.Variable.Name.Value] = v.Value
+		}
+	}
+	intArg := func(field *ast.Field, name string, def int) int {
+		for _, arg := range field.Arguments {
+			if arg.Name.Value != name {
+				continue
+			}
+			var v interface{}
+			switch value := arg.Value.(type) {
+			case *ast.IntValue:
+				v = value.Value
+			case *ast.Variable:
+				var ok bool
+				if v, ok = variables[value.Name.Value]; !ok {
+					v = defaults[value.Name.Value]
+				}
+			}
+			switch v := v.(type) {
+			case string:
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					// out of range, so as costly as can be
+					return graphqlMaxSize
+				}
+				return clampGraphQLSize(float64(n))
+			case float64:
+				return clampGraphQLSize(v)
+			case int:
+				return clampGraphQLSize(float64(v))
+			}
+		}
+		return def
+	}
+
+	// pageSize is the size of the search hits are in
+	var cost func(set *ast.SelectionSet, multiplier, pageSize int) int
+	cost = func(set *ast.SelectionSet, multiplier, pageSize int) int {
+		if set == nil {
+			return 0
+		}
+		total := 0
+		for _, selection := range set.Selections {
+			switch selection := selection.(type) {
+			case *ast.Field:
+				total = addGraphQLCost(total, multiplier)
+				childMultiplier, childPageSize := multiplier, pageSize
+				switch selection.Name.Value {
+				case "search":
+					childPageSize = intArg(selection, "size", graphqlDefaultSize)
+				case "hits":
+					childMultiplier = mulGraphQLCost(childMultiplier, pageSize)
+				case "beers":
+					childMultiplier = mulGraphQLCost(childMultiplier, intArg(selection, "size", graphqlDefaultSize))
+				}
+				total = addGraphQLCost(total, cost(selection.SelectionSet, childMultiplier, childPageSize))
+			case *ast.InlineFragment:
+				total = addGraphQLCost(total, cost(selection.SelectionSet, multiplier, pageSize))
+			case *ast.FragmentSpread:
+				if fragment := fragments[selection.Name.Value]; fragment != nil {
+					total = addGraphQLCost(total, cost(fragment.SelectionSet, multiplier, pageSize))
+				}
+			}
+		}
+		return total
+	}
+	return cost(operation.SelectionSet, 1, graphqlDefaultSize)
+}
+
+// graphqlMaxSize is the largest size a query's cost is reckoned with,
+// and graphqlCostCap the most a query can cost, so that sizes of any
+// magnitude can't overflow it.
+const (
+	graphqlMaxSize = 1 << 20
+	graphqlCostCap = 1 << 30
+)
+
+// clampGraphQLSize returns a size for the cost of a query: a negative
+// size, which fails when resolved, costs nothing, rather than cancelling
+// out the cost of other fields.
+func clampGraphQLSize(size float64) int {
+	switch {
+	case size < 0:
+		return 0
+	case size > graphqlMaxSize:
+		return graphqlMaxSize
+	}
+	return int(size)
+}
+
+func addGraphQLCost(a, b int) int {
+	if a+b > graphqlCostCap {
+		return graphqlCostCap
+	}
+	return a + b
+}
+
+func mulGraphQLCost(a, b int) int {
+	if b != 0 && a > graphqlCostCap/b {
+		return graphqlCostCap
+	}
+	return a * b
+}
+
+// graphqlHandler serves GraphQL queries, as a JSON body with query,
+// variables and operationName, or for GET as URL parameters. Queries
+// that cost more than maxCost are refused before they run. Errors in
+// the query are GraphQL errors rather than API errors, as clients
+// expect.
+type graphqlHandler struct {
+	defaultIndexName string
+	maxTimeout       time.Duration
+	maxCost          int
+	schema           graphql.Schema
+}
+
+func newGraphQLHandler(defaultIndexName string, maxTimeout time.Duration, maxCost int) (*graphqlHandler, error) {
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlHandler{
+		defaultIndexName: defaultIndexName,
+		maxTimeout:       maxTimeout,
+		maxCost:          maxCost,
+		schema:           schema,
+	}, nil
+}
+
+func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	index := bleveHttp.IndexByName(h.defaultIndexName)
+	if index == nil {
+		showError(w, req, fmt.Sprintf("no such index '%s'", h.defaultIndexName), 404)
+		return
+	}
+
+	var graphqlRequest struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+	if req.Method == "GET" {
+		params := req.URL.Query()
+		graphqlRequest.Query = params.Get("query")
+		graphqlRequest.OperationName = params.Get("operationName")
+		if variables := params.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &graphqlRequest.Variables); err != nil {
+				showError(w, req, fmt.Sprintf("error parsing variables: %v", err), 400)
+				return
+			}
+		}
+	} else {
+		requestBody, err := io.ReadAll(req.Body)
+		if err != nil {
+			showError(w, req, fmt.Sprintf("error reading request body: %v", err), 400)
+			return
+		}
+		if err := json.Unmarshal(requestBody, &graphqlRequest); err != nil {
+			showError(w, req, fmt.Sprintf("error parsing request: %v", err), 400)
+			return
+		}
+	}
+	if graphqlRequest.Query == "" {
+		showError(w, req, "a query is required", 400)
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(graphqlRequest.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		writeGraphQLErrors(w, gqlerrors.FormatErrors(err))
+		return
+	}
+	if validation := graphql.ValidateDocument(&h.schema, doc, nil); !validation.IsValid {
+		writeGraphQLErrors(w, validation.Errors)
+		return
+	}
+	if cost := graphqlCost(doc, graphqlRequest.OperationName, graphqlRequest.Variables); cost > h.maxCost {
+		e := gqlerrors.NewFormattedError(fmt.Sprintf("query costs %d, more than the limit of %d", cost, h.maxCost))
+		e.Extensions = map[string]interface{}{"code": "query_too_costly", "cost": cost, "max_cost": h.maxCost}
+		writeGraphQLErrors(w, []gqlerrors.FormattedError{e})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.maxTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, graphqlLoaderKey{}, newGraphQLLoader(index, h.maxTimeout))
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        h.schema,
+		AST:           doc,
+		OperationName: graphqlRequest.OperationName,
+		Args:          graphqlRequest.Variables,
+		Context:       ctx,
+	})
+	mustEncode(w, result)
+}
+
+// writeGraphQLErrors refuses a query that doesn't parse, validate or
+// fit the cost limit.
+func writeGraphQLErrors(w http.ResponseWriter, errs []gqlerrors.FormattedError) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(&graphql.Result{Errors: errs})
+}
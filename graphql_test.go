@@ -0,0 +1,191 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func TestGraphQLCost(t *testing.T) {
+	tests := []struct {
+		query     string
+		variables map[string]interface{}
+		cost      int
+	}{
+		{`{ beer(id: "x") { name } }`, nil, 2},
+		// 1 search, 1 hits, and 10 hits of 2 fields
+		{`{ search { hits { id score } } }`, nil, 22},
+		{`{ search(size: 2) { total hits { document { ... on Beer { brewery { beers(size: 5) { name } } } } } } }`, nil, 3 + 2*3 + 2*5},
+		{`query($n: Int) { search(size: $n) { hits { id } } }`, map[string]interface{}{"n": 100.0}, 102},
+		{`query($n: Int = 3) { search(size: $n) { hits { id } } }`, nil, 5},
+		{`{ search(size: 4) { hits { ...hit } } } fragment hit on Hit { id score }`, nil, 10},
+		// a negative size costs nothing rather than cancelling others out
+		{`{ a: search(size: -1000) { hits { id } } b: search(size: 100) { hits { id } } }`, nil, 2 + 102},
+		{`query($n: Int) { search(size: $n) { hits { id } } }`, map[string]interface{}{"n": -1e300}, 2},
+		// sizes too big to count with saturate
+		{`query($n: Int) { search(size: $n) { hits { document { ... on Beer { brewery { beers(size: $n) { brewery { beers(size: $n) { brewery { beers(size: $n) { name } } } } } } } } } } }`, map[string]interface{}{"n": 1e300}, graphqlCostCap},
+		{`{ search(size: 99999999999999999999) { hits { id } } }`, nil, 2 + graphqlMaxSize},
+	}
+	for _, test := range tests {
+		doc, err := parser.Parse(parser.ParseParams{Source: test.query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cost := graphqlCost(doc, "", test.variables); cost != test.cost {
+			t.Errorf("%s: expected cost %d, got %d", test.query, test.cost, cost)
+		}
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	router := newTestRouter(t, "beer", 17)
+	ctx := context.Background()
+
+	// lookups at the same depth are batched, and each made once
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := newGraphQLLoader(bleveHttp.IndexByName("beer"), time.Minute)
+	result := graphql.Do(graphql.Params{
+		Schema: schema,
+		RequestString: `{
+			ipa: beer(id: "21st_amendment_brewery_cafe-21a_ipa") { name brewery { name } }
+			stout: beer(id: "21st_amendment_brewery_cafe-563_stout") { name brewery { name } }
+			other: brewery(id: "357") { name }
+			missing: beer(id: "nonesuch") { name }
+			notBeer: beer(id: "357") { name }
+		}`,
+		Context: context.WithValue(ctx, graphqlLoaderKey{}, loader),
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	data, _ := json.Marshal(result.Data)
+	expected := `{"ipa":{"brewery":{"name":"21st Amendment Brewery Cafe"},"name":"21A IPA"},"missing":null,"notBeer":null,"other":{"name":"357"},"stout":{"brewery":{"name":"21st Amendment Brewery Cafe"},"name":"563 Stout"}}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+	if loader.batches != 2 {
+		t.Errorf("expected the beers and then their brewery to be looked up in 2 batches, got %d", loader.batches)
+	}
+
+	// the beers of several breweries are one search
+	loader = newGraphQLLoader(bleveHttp.IndexByName("beer"), time.Minute)
+	result = graphql.Do(graphql.Params{
+		Schema: schema,
+		RequestString: `{
+			amendment: brewery(id: "21st_amendment_brewery_cafe") { beers(size: 11, sort: "_id") { name } }
+			fonteinen: brewery(id: "3_fonteinen_brouwerij_ambachtelijke_geuzestekerij") { beers(size: 2, sort: "_id") { name } }
+			none: brewery(id: "357") { beers(sort: "_id") { name } }
+		}`,
+		Context: context.WithValue(ctx, graphqlLoaderKey{}, loader),
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	data, _ = json.Marshal(result.Data)
+	expected = `{"amendment":{"beers":[{"name":"21A IPA"},{"name":"563 Stout"},{"name":"Amendment Pale Ale"},{"name":"Bitter American"},{"name":"Double Trouble IPA"},{"name":"General Pippo's Porter"},{"name":"North Star Red"},{"name":"Oyster Point Oyster Stout"},{"name":"Potrero ESB"},{"name":"South Park Blonde"},{"name":"Watermelon Wheat"}]},"fonteinen":{"beers":[{"name":"Drie Fonteinen Kriek"},{"name":"Oude Geuze"}]},"none":{"beers":[]}}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+	if loader.batches != 2 {
+		t.Errorf("expected the breweries and then their beers to be looked up in 2 batches, got %d", loader.batches)
+	}
+
+	// one brewery's strongest beers don't crowd out another's
+	result = graphql.Do(graphql.Params{
+		Schema: schema,
+		RequestString: `{
+			amendment: brewery(id: "21st_amendment_brewery_cafe") { beers(size: 1) { name } }
+			fonteinen: brewery(id: "3_fonteinen_brouwerij_ambachtelijke_geuzestekerij") { beers(size: 2) { name } }
+		}`,
+		Context: context.WithValue(ctx, graphqlLoaderKey{}, newGraphQLLoader(bleveHttp.IndexByName("beer"), time.Minute)),
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	data, _ = json.Marshal(result.Data)
+	expected = `{"amendment":{"beers":[{"name":"Double Trouble IPA"}]},"fonteinen":{"beers":[{"name":"Oude Geuze"},{"name":"Drie Fonteinen Kriek"}]}}`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+
+	post := func(body string) (int, *graphql.Result) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/graphql", strings.NewReader(body)))
+		var result graphql.Result
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		return rec.Code, &result
+	}
+
+	// a beer with its brewery and its brewery's strongest beers
+	code, result := post(`{"query": "query($q: String) { search(query: $q, size: 1, facets: [\"style\"]) { total hits { document { ... on Beer { name brewery { name beers(size: 2) { abv } } } } } facets { field terms { term count } } } }", "variables": {"q": "name:stout"}}`)
+	if code != 200 || len(result.Errors) > 0 {
+		t.Fatalf("expected the search to succeed, got %d %v", code, result.Errors)
+	}
+	var page struct {
+		Search struct {
+			Total int
+			Hits  []struct {
+				Document struct {
+					Name    string
+					Brewery struct {
+						Name  string
+						Beers []struct{ Abv float64 }
+					}
+				}
+			}
+			Facets []struct {
+				Field string
+				Terms []struct {
+					Term  string
+					Count int
+				}
+			}
+		}
+	}
+	data, _ = json.Marshal(result.Data)
+	if err := json.Unmarshal(data, &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Search.Total != 2 || len(page.Search.Hits) != 1 || !strings.Contains(page.Search.Hits[0].Document.Name, "Stout") {
+		t.Fatalf("expected a stout of 2, got %s", data)
+	}
+	brewery := page.Search.Hits[0].Document.Brewery
+	if brewery.Name != "21st Amendment Brewery Cafe" || len(brewery.Beers) != 2 || brewery.Beers[0].Abv < brewery.Beers[1].Abv {
+		t.Errorf("expected the brewery's 2 strongest beers, got %+v", brewery)
+	}
+	if len(page.Search.Facets) != 1 || page.Search.Facets[0].Field != "style" ||
+		len(page.Search.Facets[0].Terms) != 1 || page.Search.Facets[0].Terms[0].Count != 2 {
+		t.Errorf("expected the style of both stouts, got %+v", page.Search.Facets)
+	}
+
+	// runaway nesting is refused before it runs
+	code, result = post(`{"query": "{ search(size: 100) { hits { document { ... on Beer { brewery { beers(size: 100) { name } } } } } } }"}`)
+	if code != 400 || len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "query_too_costly" {
+		t.Errorf("expected the query to be too costly, got %d %+v", code, result.Errors)
+	}
+	code, result = post(`{"query": "{ search { tota } }"}`)
+	if code != 400 || len(result.Errors) != 1 {
+		t.Errorf("expected an unknown field to be refused, got %d %+v", code, result.Errors)
+	}
+}
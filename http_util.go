@@ -11,18 +11,38 @@
 package main
 
 import (
+	"encoding/json"
+	"io"
+	"io/fs"
 	"net/http"
 
 	"github.com/gorilla/mux"
 )
 
-func staticFileRouter() *mux.Router {
+func staticFileRouter() (*mux.Router, error) {
 	r := mux.NewRouter()
 	r.StrictSlash(true)
 
-	// static
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/",
-		myFileHandler{http.FileServer(http.Dir(*staticPath))}))
+	// static, from the binary unless a directory is given
+	var staticHandler, indexHandler http.Handler
+	if *staticPath != "" {
+		fileServer := http.FileServer(http.Dir(*staticPath))
+		staticHandler = fileServer
+		// if you try to use index.html it will redirect...poorly
+		indexHandler = RewriteURL("/", fileServer)
+	} else {
+		staticFS, err := fs.Sub(embeddedStatic, "static")
+		if err != nil {
+			return nil, err
+		}
+		assets, err := loadStaticAssets(staticFS)
+		if err != nil {
+			return nil, err
+		}
+		staticHandler = assets
+		indexHandler = RewriteURL("/index.html", assets)
+	}
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticHandler))
 
 	// application pages
 	appPages := []string{
@@ -31,25 +51,12 @@ func staticFileRouter() *mux.Router {
 	}
 
 	for _, p := range appPages {
-		// if you try to use index.html it will redirect...poorly
-		r.PathPrefix(p).Handler(RewriteURL("/",
-			http.FileServer(http.Dir(*staticPath))))
+		r.PathPrefix(p).Handler(indexHandler)
 	}
 
 	r.Handle("/", http.RedirectHandler("/static/index.html", http.StatusFound))
 
-	return r
-}
-
-type myFileHandler struct {
-	h http.Handler
-}
-
-func (mfh myFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if *staticEtag != "" {
-		w.Header().Set("Etag", *staticEtag)
-	}
-	mfh.h.ServeHTTP(w, r)
+	return r, nil
 }
 
 func RewriteURL(to string, h http.Handler) http.Handler {
@@ -66,3 +73,21 @@ func muxVariableLookup(req *http.Request, name string) string {
 func docIDLookup(req *http.Request) string {
 	return muxVariableLookup(req, "docID")
 }
+
+// showError reports an error as a JSON apiError, with the default code
+// for its status.
+func showError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	showErrorDetails(w, r, msg, code, "", nil)
+}
+
+func mustEncode(w io.Writer, i interface{}) {
+	if headered, ok := w.(http.ResponseWriter); ok {
+		headered.Header().Set("Cache-Control", "no-cache")
+		headered.Header().Set("Content-type", "application/json")
+	}
+
+	e := json.NewEncoder(w)
+	if err := e.Encode(i); err != nil {
+		panic(err)
+	}
+}
@@ -10,20 +10,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	_ "expvar"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/blevesearch/bleve/v2"
 	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/gorilla/mux"
 )
 
 var (
@@ -31,138 +39,472 @@ var (
 	bindAddr   = flag.String("addr", ":8094", "http listen address")
 	jsonDir    = flag.String("jsonDir", "data/", "json directory")
 	indexPath  = flag.String("index", "beer-search.bleve", "index path")
-	staticEtag = flag.String("staticEtag", "", "A static etag value.")
-	staticPath = flag.String("static", "static/", "Path to the static content")
+	staticEtag = flag.String("staticEtag", "", "deprecated and ignored, static files have ETags of their content")
+	staticPath = flag.String("static", "", "serve the static content from this directory rather than the binary")
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile = flag.String("memprofile", "", "write mem profile to file")
+
+	shutdownTimeout = flag.Duration("shutdownTimeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	// settings not given as flags come from the environment or a file
+	err := loadConfig(flag.CommandLine, os.Getenv)
+	if err == nil {
+		err = validateConfig()
+	}
+	if err != nil {
+		log.Printf("invalid configuration: %v", err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		if err := writeConfig(os.Stdout, flag.CommandLine); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	log.Printf("GOMAXPROCS: %d", runtime.GOMAXPROCS(-1))
+	if *staticEtag != "" {
+		log.Printf("-staticEtag is deprecated and ignored, static files have ETags of their content")
+	}
+
+	// shut down cleanly on interrupt or termination
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	var status int
+	switch flag.Arg(0) {
+	case "", "serve":
+		status = serve(ctx)
+	case "index":
+		status = indexCommand(ctx, flag.Args()[1:])
+	case "query":
+		status = queryCommand(ctx, flag.Args()[1:])
+	case "stats":
+		status = statsCommand(flag.Args()[1:])
+	case "dump":
+		status = dumpCommand(ctx, flag.Args()[1:])
+	case "backup":
+		status = backupCommand(flag.Args()[1:])
+	case "restore":
+		status = restoreCommand(flag.Args()[1:])
+	default:
+		log.Printf("unknown command %q", flag.Arg(0))
+		status = 2
+	}
+	stop()
+	os.Exit(status)
+}
+
+// serve opens (or creates and populates) the index and serves the
+// application until ctx is done or something fails. It always closes
+// the index before returning, and returns the process exit status.
+func serve(ctx context.Context) int {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if *cpuprofile != "" {
-		f, err := os.Create(*cpuprofile)
+	if err := startProfiles(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer stopProfiles()
+
+	// access logs, and traces if wanted
+	var accessLogFile io.Writer
+	if *accessLogPath != "" {
+		f, err := openLogFile(*accessLogPath)
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
+			return 1
 		}
-
-		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Fatal(err)
+		defer f.Close()
+		accessLogFile = f
+	}
+	var spans *spanExporter
+	if *tracePath != "" {
+		f, err := openLogFile(*tracePath)
+		if err != nil {
+			log.Print(err)
+			return 1
 		}
+		defer f.Close()
+		spans = newSpanExporter(f)
+		ctx = withSpanExporter(ctx, spans)
+	}
+	requestLog := newAccessLog(accessLogFile, spans)
+
+	// where and how to listen
+	addr, err := parseListenAddr(*bindAddr)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	tlsConfig, err := newTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	certs := newClientCerts(*tlsClientCA)
+	// listening before opening the index fails fast if the address is
+	// taken; connections wait until the server is ready
+	listener, err := addr.listen()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer listener.Close()
+
+	// errors from the indexer and the HTTP server end up here
+	errs := make(chan error, 2)
+	var indexing sync.WaitGroup
+
+	// saved searches, checked as documents are indexed
+	saved, err := loadSavedSearches(*indexPath + ".saved.json")
+	if err != nil {
+		log.Print(err)
+		return 1
 	}
+	defer saved.Close()
 
 	// open the index
-	beerIndex, err := bleve.Open(*indexPath)
+	path, err := activeIndexPath(*indexPath)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	created := false
+	beerIndex, err := openIndex(path)
 	if err == bleve.ErrorIndexPathDoesNotExist {
 		log.Printf("Creating new index...")
 		// create a mapping
 		indexMapping, err := buildIndexMapping()
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
+			return 1
 		}
-		beerIndex, err = bleve.New(*indexPath, indexMapping)
+		beerIndex, err = newIndex(path, indexMapping, *shardCount)
 		if err != nil {
-			log.Fatal(err)
+			log.Print(err)
+			return 1
+		}
+		created = true
+	} else if err != nil {
+		log.Print(err)
+		return 1
+	} else {
+		log.Printf("Opening existing index...")
+	}
+
+	live := newLiveIndex("beer", *indexPath, beerIndex, path, saved)
+	defer func() {
+		// wait for the indexer to flush its last batch before closing
+		indexing.Wait()
+		if err := live.Close(); err != nil {
+			log.Printf("error closing index: %v", err)
 		}
+	}()
 
-		// index data in the background
+	if created {
+		// index data in the background, holding off reindexing until done
+		live.acquire()
+		indexing.Add(1)
 		go func() {
-			err = indexBeer(beerIndex)
+			defer indexing.Done()
+			defer live.release()
+			_, err := indexBeer(ctx, beerIndex, func(ids []string) {
+				saved.check(beerIndex, ids, nil)
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				errs <- fmt.Errorf("indexing: %v", err)
+				return
+			}
+			stopProfiles()
+		}()
+	}
+
+	// API keys, if configured
+	var keys *apiKeys
+	if *keysFile != "" {
+		var audit io.Writer = os.Stderr
+		if *auditLogPath != "" {
+			f, err := os.OpenFile(*auditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 			if err != nil {
-				log.Fatal(err)
+				log.Print(err)
+				return 1
 			}
-			pprof.StopCPUProfile()
-			if *memprofile != "" {
-				f, err := os.Create(*memprofile)
-				if err != nil {
-					log.Fatal(err)
-				}
+			defer f.Close()
+			audit = f
+		}
+		keys, err = loadAPIKeys(*keysFile, audit)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+	} else if *insecureOpenAdmin {
+		keys = &apiKeys{open: true}
+		log.Printf("No API keys file, write and admin endpoints are open")
+	} else {
+		log.Printf("No API keys file, write and admin endpoints are refused")
+	}
+
+	routeLimits, err := parseRateLimits(*rateLimits)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	lim := newLimits(routeLimits, *maxConcurrentSearches, *searchQueueLength, *searchQueueWait)
+	crossOrigin, err := newCORS(*corsOrigins, *corsMethods, *corsHeaders, *corsMaxAge)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
 
-				if err := pprof.WriteHeapProfile(f); err != nil {
-					log.Fatal(err)
-				}
+	// create a router to serve static files and the API
+	router, err := newRouter(ctx, live, saved, keys, lim, certs)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
 
-				f.Close()
-			}
+	// start the HTTP server
+	http.Handle("/", requestLog.wrap(negotiate(jsonErrors(crossOrigin.wrap(router)), *compressMinSize)))
+	server := &http.Server{TLSConfig: tlsConfig}
+	if !*enableHTTP2 {
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	if tlsConfig != nil {
+		log.Printf("Listening on %s", addr.url("https"))
+		go func() {
+			errs <- server.ServeTLS(listener, "", "")
 		}()
-	} else if err != nil {
-		log.Fatal(err)
 	} else {
-		log.Printf("Opening existing index...")
+		log.Printf("Listening on %s", addr.url("http"))
+		go func() {
+			errs <- server.Serve(listener)
+		}()
 	}
 
-	// create a router to serve static files
-	router := staticFileRouter()
+	status := 0
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down...")
+	case err := <-errs:
+		log.Print(err)
+		status = 1
+	}
+
+	// stop indexing and let in-flight requests drain
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down HTTP server: %v", err)
+		status = 1
+	}
+
+	return status
+}
+
+// newRouter returns the router for the static files and the API of
+// live, with errors as JSON and the matched route noted for the access
+// log. ctx bounds background work the API starts, like reindexing.
+func newRouter(ctx context.Context, live *liveIndex, saved *savedSearches, keys *apiKeys, lim *limits, certs *clientCerts) (*mux.Router, error) {
+	router, err := staticFileRouter()
+	if err != nil {
+		return nil, err
+	}
 
 	// add the API
-	bleveHttp.RegisterIndexName("beer", beerIndex)
-	searchHandler := bleveHttp.NewSearchHandler("beer")
-	router.Handle("/api/search", searchHandler).Methods("POST")
-	listFieldsHandler := bleveHttp.NewListFieldsHandler("beer")
-	router.Handle("/api/fields", listFieldsHandler).Methods("GET")
+	searchHandler := newSearchHandler(live.name, *searchTimeout, newSearchCache(*searchCacheSize, *searchCacheTTL))
+	router.Handle("/api/search", keys.require(roleRead, lim.search("/api/search", searchHandler))).Methods("GET", "POST")
+	exportHandler := newExportHandler(live.name, *searchTimeout)
+	router.Handle("/api/export", keys.require(roleRead, lim.search("/api/export", exportHandler))).Methods("GET", "POST")
+	graphqlHandler, err := newGraphQLHandler(live.name, *searchTimeout, *graphqlMaxCost)
+	if err != nil {
+		return nil, err
+	}
+	router.Handle("/graphql", keys.require(roleRead, lim.search("/graphql", graphqlHandler))).Methods("GET", "POST")
+	listFieldsHandler := bleveHttp.NewListFieldsHandler(live.name)
+	router.Handle("/api/fields", keys.require(roleRead, lim.route("/api/fields", listFieldsHandler))).Methods("GET")
+	fieldTermsHandler := newFieldTermsHandler(live.name)
+	router.Handle("/api/fields/{field}/terms", keys.require(roleRead, lim.search("/api/fields/{field}/terms", fieldTermsHandler))).Methods("GET")
+	fieldStatsHandler := newFieldStatsHandler(live.name)
+	router.Handle("/api/fields/{field}/stats", keys.require(roleRead, lim.search("/api/fields/{field}/stats", fieldStatsHandler))).Methods("GET")
+
+	validateHandler := newValidateHandler(live.name)
+	router.Handle("/api/validate", keys.require(roleRead, lim.route("/api/validate", validateHandler))).Methods("POST")
+	analyzeHandler := newAnalyzeHandler(live.name)
+	router.Handle("/api/analyze", keys.require(roleRead, lim.route("/api/analyze", analyzeHandler))).Methods("POST")
+	openAPIHandler := newOpenAPIHandler()
+	router.Handle("/api/openapi.json", keys.require(roleRead, lim.route("/api/openapi.json", openAPIHandler))).Methods("GET")
 
-	debugHandler := bleveHttp.NewDebugDocumentHandler("beer")
+	savedSearchesHandler := newSavedSearchesHandler(saved)
+	router.Handle("/api/saved", keys.require(roleRead, lim.route("/api/saved", savedSearchesHandler))).Methods("GET")
+	savedSearchHandler := newSavedSearchHandler(saved)
+	router.Handle("/api/saved/{name}", keys.require(roleRead, lim.route("/api/saved/{name}", savedSearchHandler))).Methods("GET")
+	router.Handle("/api/saved/{name}", keys.require(roleWrite, lim.route("/api/saved/{name}", savedSearchHandler))).Methods("PUT", "DELETE")
+	savedMatchesHandler := newSavedMatchesHandler(saved)
+	router.Handle("/api/saved/{name}/matches", keys.require(roleRead, lim.route("/api/saved/{name}/matches", savedMatchesHandler))).Methods("GET")
+
+	docGetHandler := bleveHttp.NewDocGetHandler(live.name)
+	docGetHandler.DocIDLookup = docIDLookup
+	router.Handle("/api/doc/{docID}", keys.require(roleRead, lim.route("/api/doc/{docID}", docGetHandler))).Methods("GET")
+	docIndexHandler := bleveHttp.NewDocIndexHandler(live.name)
+	docIndexHandler.DocIDLookup = docIDLookup
+	router.Handle("/api/doc/{docID}", keys.require(roleWrite, lim.route("/api/doc/{docID}", live.refuseWhileReplacing(docIndexHandler)))).Methods("PUT")
+	docDeleteHandler := bleveHttp.NewDocDeleteHandler(live.name)
+	docDeleteHandler.DocIDLookup = docIDLookup
+	router.Handle("/api/doc/{docID}", keys.require(roleWrite, lim.route("/api/doc/{docID}", live.refuseWhileReplacing(docDeleteHandler)))).Methods("DELETE")
+
+	debugHandler := bleveHttp.NewDebugDocumentHandler(live.name)
+	debugHandler.IndexNameLookup = live.shardNameLookup
 	debugHandler.DocIDLookup = docIDLookup
-	router.Handle("/api/debug/{docID}", debugHandler).Methods("GET")
+	router.Handle("/api/debug/{docID}", certs.require(keys.require(roleAdmin, lim.route("/api/debug/{docID}", traced("debug", debugHandler))))).Methods("GET")
 
-	// start the HTTP server
-	http.Handle("/", router)
+	backupHandler := newBackupHandler(live, *backupDir)
+	router.Handle("/api/admin/backup", certs.require(keys.require(roleAdmin, lim.route("/api/admin/backup", backupHandler)))).Methods("POST")
+	reindexHandler := newReindexHandler(ctx, live)
+	router.Handle("/api/admin/reindex", certs.require(keys.require(roleAdmin, lim.route("/api/admin/reindex", reindexHandler)))).Methods("GET", "POST")
+	rollbackHandler := newRollbackHandler(live)
+	router.Handle("/api/admin/rollback", certs.require(keys.require(roleAdmin, lim.route("/api/admin/rollback", rollbackHandler)))).Methods("POST")
+
+	// errors are JSON, whichever handler they come from
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = methodNotAllowed(router)
+
+	router.Use(noteRoute)
+	return router, nil
+}
+
+var (
+	cpuProfileFile   *os.File
+	stopProfilesOnce sync.Once
+)
+
+// startProfiles starts the CPU profile, if one was requested.
+func startProfiles() error {
+	if *cpuprofile == "" {
+		return nil
+	}
 
-	address := strings.Split(*bindAddr, ":")
-	host := address[0]
-	port := address[1]
+	f, err := os.Create(*cpuprofile)
+	if err != nil {
+		return err
+	}
 
-	if host == "" {
-		host = "localhost"
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return err
 	}
+	cpuProfileFile = f
+	return nil
+}
+
+// stopProfiles stops the CPU profile and writes the heap profile, if
+// either was requested. Only the first call has any effect, so it can be
+// called both when indexing completes and on shutdown.
+func stopProfiles() {
+	stopProfilesOnce.Do(func() {
+		if cpuProfileFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuProfileFile.Close(); err != nil {
+				log.Printf("error writing cpu profile: %v", err)
+			}
+		}
+
+		if *memprofile != "" {
+			f, err := os.Create(*memprofile)
+			if err != nil {
+				log.Printf("error creating mem profile: %v", err)
+				return
+			}
 
-	log.Printf("Listening on http://%v:%v", host, port)
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				log.Printf("error writing mem profile: %v", err)
+			}
 
-	log.Fatal(http.ListenAndServe(*bindAddr, nil))
+			f.Close()
+		}
+	})
 }
 
-func indexBeer(i bleve.Index) error {
+// indexBeer indexes every JSON file in jsonDir and returns how many it
+// indexed. If ctx is cancelled it stops early, but still flushes the
+// batch in progress, and returns the context's error. If indexed is not
+// nil, it is called with the IDs of the documents of each batch once the
+// batch is flushed.
+func indexBeer(ctx context.Context, i bleve.Index, indexed func(ids []string)) (int, error) {
 	// open the directory
 	dirEntries, err := os.ReadDir(*jsonDir)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// walk the directory entries for indexing
 	log.Printf("Indexing...")
 	count := 0
 	startTime := time.Now()
-	batch := i.NewBatch()
+	// each shard gets its own batch, and they are flushed together
+	shards := indexShards(i)
+	batches := make([]*bleve.Batch, len(shards))
+	for n, shard := range shards {
+		batches[n] = shard.NewBatch()
+	}
 	batchCount := 0
+	var batchIDs []string
+	flush := func() error {
+		_, span := startSpan(ctx, "index.batch")
+		span.set("docs", len(batchIDs))
+		err := flushBatches(shards, batches)
+		span.end(err)
+		if err != nil {
+			return err
+		}
+		if indexed != nil {
+			indexed(batchIDs)
+		}
+		batchIDs = batchIDs[:0]
+		return nil
+	}
 	for _, dirEntry := range dirEntries {
+		if ctx.Err() != nil {
+			log.Printf("Indexing cancelled")
+			break
+		}
 		filename := dirEntry.Name()
 		// read the bytes
 		jsonBytes, err := os.ReadFile(*jsonDir + "/" + filename)
 		if err != nil {
-			return err
+			return count, err
 		}
 		// parse bytes as json
 		var jsonDoc interface{}
 		err = json.Unmarshal(jsonBytes, &jsonDoc)
 		if err != nil {
-			return err
+			return count, err
 		}
 		ext := filepath.Ext(filename)
 		docID := filename[:(len(filename) - len(ext))]
+		batch := batches[shardFor(docID, len(shards))]
 		if err := batch.Index(docID, jsonDoc); err != nil {
-			return err
+			return count, err
 		}
 
+		batchIDs = append(batchIDs, docID)
 		batchCount++
 
 		if batchCount >= *batchSize {
-			err = i.Batch(batch)
+			err = flush()
 			if err != nil {
-				return err
+				return count, err
 			}
-			batch = i.NewBatch()
 			batchCount = 0
 		}
 		count++
@@ -175,14 +517,14 @@ func indexBeer(i bleve.Index) error {
 	}
 	// flush the last batch
 	if batchCount > 0 {
-		err = i.Batch(batch)
+		err = flush()
 		if err != nil {
-			log.Fatal(err)
+			return count, err
 		}
 	}
 	indexDuration := time.Since(startTime)
 	indexDurationSeconds := float64(indexDuration) / float64(time.Second)
 	timePerDoc := float64(indexDuration) / float64(count)
 	log.Printf("Indexed %d documents, in %.2fs (average %.2fms/doc)", count, indexDurationSeconds, timePerDoc/float64(time.Millisecond))
-	return nil
+	return count, ctx.Err()
 }
@@ -10,7 +10,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"sync"
@@ -290,3 +292,91 @@ func TestBeerSearchBug87(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestIndexBeerCancelled(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = indexBeer(ctx, index, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	count, err := index.DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected no documents indexed, got %d", count)
+	}
+}
+
+// indexTestBeer indexes the first n documents of the data directory into
+// index, for tests that don't need the whole corpus.
+func indexTestBeer(t *testing.T, index bleve.Index, n int) {
+	dirEntries, err := os.ReadDir("data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := index.NewBatch()
+	for _, dirEntry := range dirEntries[:n] {
+		filename := dirEntry.Name()
+		jsonBytes, err := os.ReadFile("data/" + filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var jsonDoc interface{}
+		err = json.Unmarshal(jsonBytes, &jsonDoc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ext := filepath.Ext(filename)
+		docId := filename[:(len(filename) - len(ext))]
+		if err := batch.Index(docId, jsonDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = index.Batch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useTestData points jsonDir at a temporary copy of the first n documents
+// of the data directory, for the duration of the test.
+func useTestData(t *testing.T, n int) {
+	dataDir := t.TempDir()
+	dirEntries, err := os.ReadDir("data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dirEntry := range dirEntries[:n] {
+		jsonBytes, err := os.ReadFile("data/" + dirEntry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dataDir, dirEntry.Name()), jsonBytes, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldDir := *jsonDir
+	*jsonDir = dataDir
+	t.Cleanup(func() { *jsonDir = oldDir })
+}
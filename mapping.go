@@ -40,6 +40,7 @@ func buildIndexMapping() (mapping.IndexMapping, error) {
 	beerMapping.AddFieldMappingsAt("type", keywordFieldMapping)
 	beerMapping.AddFieldMappingsAt("style", keywordFieldMapping)
 	beerMapping.AddFieldMappingsAt("category", keywordFieldMapping)
+	beerMapping.AddFieldMappingsAt("brewery_id", keywordFieldMapping)
 
 	breweryMapping := bleve.NewDocumentMapping()
 	breweryMapping.AddFieldMappingsAt("name", englishTextFieldMapping)
@@ -0,0 +1,388 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var compressMinSize = flag.Int("compressMinSize", 1024, "smallest response to compress, in bytes (-1 to disable compression)")
+
+// msgpackTypes are the media types a client may Accept to get MessagePack
+// rather than JSON.
+var msgpackTypes = []string{"application/msgpack", "application/vnd.msgpack", "application/x-msgpack"}
+
+// negotiate wraps h so that its responses are compressed with zstd or
+// gzip, whichever the client prefers in Accept-Encoding, once they reach
+// minSize bytes, and its JSON responses are turned into MessagePack for
+// clients that Accept it. A negative minSize turns compression off.
+func negotiate(h http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var cw *compressWriter
+		if minSize >= 0 {
+			cw = &compressWriter{
+				ResponseWriter: w,
+				encoding:       chooseEncoding(req.Header.Get("Accept-Encoding")),
+				minSize:        minSize,
+				code:           http.StatusOK,
+			}
+			w = cw
+		}
+		var mw *msgpackWriter
+		if wantsMsgpack(req.Header.Get("Accept")) {
+			mw = &msgpackWriter{ResponseWriter: w, code: http.StatusOK}
+			w = mw
+		}
+
+		// on a panic, the server drops the connection, so nothing buffered
+		// is sent
+		h.ServeHTTP(w, req)
+
+		if mw != nil {
+			mw.close()
+		}
+		if cw != nil {
+			cw.close()
+		}
+	})
+}
+
+// headerQ returns the quality given to value in a header listing values
+// with optional q parameters, like Accept or Accept-Encoding, or -1 if it
+// isn't listed.
+func headerQ(header, value string) float64 {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), value) {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(param, "="); ok && strings.TrimSpace(k) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+			}
+		}
+		return q
+	}
+	return -1
+}
+
+// chooseEncoding returns the content coding to compress a response with,
+// or "" for none. zstd wins a tie, being faster than gzip.
+func chooseEncoding(acceptEncoding string) string {
+	zstdQ, gzipQ := headerQ(acceptEncoding, "zstd"), headerQ(acceptEncoding, "gzip")
+	switch {
+	case zstdQ > 0 && zstdQ >= gzipQ:
+		return "zstd"
+	case gzipQ > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// wantsMsgpack reports whether an Accept header prefers MessagePack to
+// JSON.
+func wantsMsgpack(accept string) bool {
+	jsonQ := headerQ(accept, "application/json")
+	for _, t := range msgpackTypes {
+		if q := headerQ(accept, t); q > 0 && q >= jsonQ {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether a content type is worth compressing:
+// text, but not images, fonts or archives, which are already compressed.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json", "application/javascript", "application/x-ndjson", "image/svg+xml":
+		return true
+	}
+	for _, t := range msgpackTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
+var zstdWriters = sync.Pool{
+	New: func() interface{} {
+		// the window is limited to what browsers are required to decode
+		w, _ := zstd.NewWriter(nil, zstd.WithWindowSize(8<<20), zstd.WithEncoderConcurrency(1))
+		return w
+	},
+}
+
+// compressor is what gzip.Writer and zstd.Encoder have in common.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter holds back the start of a response until it has minSize
+// bytes, and then, if the response is of a type worth compressing and
+// isn't already compressed, compresses it. A flush starts the response,
+// compressed, whatever its size, as a streamed response may be large.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	code     int
+	buf      []byte
+	started  bool
+	enc      compressor
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.started || code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.code = code
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		c.start(false)
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.started {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) < c.minSize {
+			return len(p), nil
+		}
+		if err := c.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if !c.started {
+		c.start(true)
+	}
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// start writes the header, deciding whether to compress, and then what
+// has been buffered.
+func (c *compressWriter) start(compress bool) error {
+	c.started = true
+	header := c.Header()
+	if header.Get("Content-Type") == "" && len(c.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	if compressible(header.Get("Content-Type")) && header.Get("Content-Encoding") == "" &&
+		c.code != http.StatusPartialContent && header.Get("Content-Range") == "" {
+		if !strings.Contains(strings.Join(header.Values("Vary"), ","), "Accept-Encoding") {
+			header.Add("Vary", "Accept-Encoding")
+		}
+		if compress && c.encoding != "" {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", c.encoding)
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+			if c.encoding == "zstd" {
+				enc := zstdWriters.Get().(*zstd.Encoder)
+				enc.Reset(c.ResponseWriter)
+				c.enc = enc
+			} else {
+				enc := gzipWriters.Get().(*gzip.Writer)
+				enc.Reset(c.ResponseWriter)
+				c.enc = enc
+			}
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.code)
+
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(buf)
+	} else {
+		_, err = c.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close finishes the response, which is sent uncompressed if it never
+// reached minSize.
+func (c *compressWriter) close() {
+	if !c.started {
+		c.start(false)
+	}
+	if c.enc == nil {
+		return
+	}
+	if err := c.enc.Close(); err != nil {
+		log.Printf("error compressing response: %v", err)
+	}
+	switch enc := c.enc.(type) {
+	case *zstd.Encoder:
+		enc.Reset(nil)
+		zstdWriters.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(nil)
+		gzipWriters.Put(enc)
+	}
+	c.enc = nil
+}
+
+// msgpackWriter holds back a JSON response to send it as MessagePack.
+// Responses of other types are passed through as they are.
+type msgpackWriter struct {
+	http.ResponseWriter
+	code    int
+	decided bool
+	json    bool
+	buf     bytes.Buffer
+}
+
+func (m *msgpackWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// decide checks whether the response is JSON, once its headers are set.
+func (m *msgpackWriter) decide() {
+	if m.decided {
+		return
+	}
+	m.decided = true
+	mediaType, _, _ := mime.ParseMediaType(m.Header().Get("Content-Type"))
+	m.json = mediaType == "application/json"
+	if !m.json {
+		m.ResponseWriter.WriteHeader(m.code)
+	}
+}
+
+func (m *msgpackWriter) WriteHeader(code int) {
+	if code < 200 {
+		m.ResponseWriter.WriteHeader(code)
+		return
+	}
+	m.code = code
+	m.decide()
+}
+
+func (m *msgpackWriter) Write(p []byte) (int, error) {
+	m.decide()
+	if m.json {
+		return m.buf.Write(p)
+	}
+	return m.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes through, except of JSON, which has to be
+// converted whole.
+func (m *msgpackWriter) Flush() {
+	m.decide()
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok && !m.json {
+		flusher.Flush()
+	}
+}
+
+func (m *msgpackWriter) close() {
+	m.decide()
+	if !m.json {
+		return
+	}
+	m.Header().Add("Vary", "Accept")
+	b, err := jsonToMsgpack(m.buf.Bytes())
+	if err != nil {
+		// send what there is, as it is
+		log.Printf("error converting response to MessagePack: %v", err)
+		m.ResponseWriter.WriteHeader(m.code)
+		m.ResponseWriter.Write(m.buf.Bytes())
+		return
+	}
+	m.Header().Set("Content-Type", msgpackTypes[0])
+	m.Header().Del("Content-Length")
+	if etag := m.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		m.Header().Set("ETag", "W/"+etag)
+	}
+	m.ResponseWriter.WriteHeader(m.code)
+	m.ResponseWriter.Write(b)
+}
+
+// jsonToMsgpack converts a JSON document to MessagePack. Converting the
+// JSON, rather than encoding the response's values directly, keeps the
+// field names and formats of their JSON marshaling.
+func jsonToMsgpack(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(msgpackValue(v))
+}
+
+// msgpackValue replaces the JSON numbers in v with integers where they
+// are whole, and floats otherwise.
+func msgpackValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, value := range v {
+			v[k] = msgpackValue(value)
+		}
+	case []interface{}:
+		for n, value := range v {
+			v[n] = msgpackValue(value)
+		}
+	}
+	return v
+}
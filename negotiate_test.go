@@ -0,0 +1,133 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiate(t *testing.T) {
+	big := map[string]interface{}{"name": strings.Repeat("Pale Ale ", 200), "abv": 5.5, "total_hits": 3}
+	handler := negotiate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/big":
+			mustEncode(w, big)
+		case "/small":
+			mustEncode(w, map[string]string{"status": "ok"})
+		case "/error":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(400)
+			w.Write([]byte(strings.Repeat("bad ", 500)))
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(make([]byte, 2000))
+		case "/stream":
+			w.Header().Set("Content-type", "application/x-ndjson")
+			w.Write([]byte("{}\n"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("{}\n"))
+		}
+	}), 1024)
+
+	get := func(path string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for n := 0; n < len(headers); n += 2 {
+			req.Header.Set(headers[n], headers[n+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) string {
+		var r io.Reader = rec.Body
+		switch rec.Header().Get("Content-Encoding") {
+		case "gzip":
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gr
+		case "zstd":
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			r = zr
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	plain := get("/big").Body.String()
+	tests := []struct {
+		path, acceptEncoding, encoding string
+	}{
+		{"/big", "", ""},
+		{"/big", "gzip, deflate", "gzip"},
+		{"/big", "gzip, zstd", "zstd"},
+		{"/big", "zstd;q=0.5, gzip", "gzip"},
+		{"/big", "zstd;q=0", ""},
+		{"/small", "gzip", ""},
+		{"/png", "gzip", ""},
+		{"/error", "zstd", "zstd"},
+		{"/stream", "gzip", "gzip"},
+	}
+	for _, test := range tests {
+		rec := get(test.path, "Accept-Encoding", test.acceptEncoding)
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%s with %q: expected encoding %q, got %q", test.path, test.acceptEncoding, test.encoding, encoding)
+			continue
+		}
+		body := decode(rec)
+		if test.path == "/big" && body != plain {
+			t.Errorf("%s with %q: expected the same body once decoded", test.path, test.acceptEncoding)
+		}
+		if test.path == "/error" && rec.Code != 400 {
+			t.Errorf("expected the error status kept, got %d", rec.Code)
+		}
+		if test.path == "/stream" && body != "{}\n{}\n" {
+			t.Errorf("expected the whole stream, got %q", body)
+		}
+	}
+
+	rec := get("/big", "Accept", "application/msgpack", "Accept-Encoding", "gzip")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Fatalf("expected MessagePack, got %s", ct)
+	}
+	var rv struct {
+		Name      string  `msgpack:"name"`
+		ABV       float64 `msgpack:"abv"`
+		TotalHits uint64  `msgpack:"total_hits"`
+	}
+	if err := msgpack.Unmarshal([]byte(decode(rec)), &rv); err != nil {
+		t.Fatal(err)
+	}
+	if rv.Name != big["name"] || rv.ABV != 5.5 || rv.TotalHits != 3 {
+		t.Errorf("expected the JSON values, got %v", rv)
+	}
+	if ct := get("/png", "Accept", "application/msgpack").Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected only JSON to be converted, got %s", ct)
+	}
+	if ct := get("/small", "Accept", "application/json, application/msgpack;q=0.5").Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON when preferred, got %s", ct)
+	}
+}
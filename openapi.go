@@ -0,0 +1,46 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"net/http"
+)
+
+// openAPIDocument describes every route of the API. TestOpenAPIRoutes
+// fails if a route is added to newRouter without it.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// openAPIHandler serves openAPIDocument, with an ETag of its content.
+type openAPIHandler struct {
+	etag string
+}
+
+func newOpenAPIHandler() *openAPIHandler {
+	sum := sha256.Sum256(openAPIDocument)
+	return &openAPIHandler{
+		etag: `"` + hex.EncodeToString(sum[:8]) + `"`,
+	}
+}
+
+func (h *openAPIHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", h.etag)
+	if etagMatches(req.Header.Get("If-None-Match"), h.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Write(openAPIDocument)
+}
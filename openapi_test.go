@@ -0,0 +1,212 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/gorilla/mux"
+
+	"github.com/blevesearch/beer-search/client"
+)
+
+// newTestRouter returns the real router, for an in memory index of the
+// first n documents registered as name, and every endpoint open.
+func newTestRouter(t *testing.T, name string, n int) *mux.Router {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexTestBeer(t, index, n)
+	saved, err := loadSavedSearches(filepath.Join(t.TempDir(), "beer-search.bleve.saved.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := newLiveIndex(name, t.TempDir(), index, "", saved)
+	t.Cleanup(func() {
+		bleveHttp.UnregisterIndexByName(name)
+		live.Close()
+		saved.Close()
+	})
+
+	router, err := newRouter(context.Background(), live, saved, &apiKeys{open: true}, newLimits(nil, 0, 0, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("expected OpenAPI 3, got %q", doc.OpenAPI)
+	}
+
+	// every API route, and GraphQL, is documented
+	routed := map[string]bool{}
+	router := newTestRouter(t, "beer-openapi-test", 1)
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !(strings.HasPrefix(template, "/api/") || template == "/graphql") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("%s: %v", template, err)
+			return nil
+		}
+		for _, method := range methods {
+			routed[method+" "+template] = true
+			if _, ok := doc.Paths[template][strings.ToLower(method)]; !ok {
+				t.Errorf("%s %s is not documented", method, template)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and everything documented is routed
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			if method == "parameters" {
+				continue
+			}
+			if !routed[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s is documented but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if rec.Code != 200 || rec.Body.String() != string(openAPIDocument) {
+		t.Errorf("expected the document, got %d", rec.Code)
+	}
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != 304 {
+		t.Errorf("expected the document not to be sent again, got %d", rec.Code)
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(jsonErrors(newTestRouter(t, "beer", 10)))
+	defer server.Close()
+	c := client.New(server.URL)
+	ctx := context.Background()
+
+	// search, a page at a time
+	q := bleve.NewMatchQuery("stout")
+	q.SetField("name")
+	searchRequest := bleve.NewSearchRequest(q)
+	searchRequest.Size = 1
+	searchRequest.Fields = []string{"name"}
+	result, err := c.Search(ctx, searchRequest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 2 || len(result.Hits) != 1 || result.Next == "" {
+		t.Fatalf("expected the first of 2 stouts and a cursor, got %+v", result)
+	}
+	next, err := c.Search(ctx, searchRequest, &client.SearchOptions{Cursor: result.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Hits) != 1 || next.Hits[0].ID == result.Hits[0].ID {
+		t.Errorf("expected the second stout, got %+v", next.Hits)
+	}
+	if name, _ := result.Hits[0].Fields["name"].(string); !strings.Contains(name, "Stout") {
+		t.Errorf("expected a stout's name, got %v", result.Hits[0].Fields)
+	}
+
+	// a bad query is the client's fault
+	_, err = c.Search(ctx, bleve.NewSearchRequest(bleve.NewQueryStringQuery("abv:>")), nil)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != 400 || apiErr.Code != codeInvalidQuery || len(apiErr.Details) == 0 {
+		t.Errorf("expected an invalid_query error, got %v", err)
+	}
+
+	// fields
+	fields, err := c.Fields(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(fields, ","), "abv") {
+		t.Errorf("expected abv among the fields, got %v", fields)
+	}
+	terms, err := c.FieldTerms(ctx, "name", "stou", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(terms.Terms) != 1 || terms.Terms[0].Term != "stout" || terms.Terms[0].Count != 2 {
+		t.Errorf("expected stout in 2 documents, got %+v", terms)
+	}
+	stats, err := c.FieldStats(ctx, "abv", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 10 || len(stats.Histogram) != 2 || stats.Min > stats.Max {
+		t.Errorf("expected stats for 10 documents, got %+v", stats)
+	}
+	if _, err := c.FieldStats(ctx, "name", 0); !errors.As(err, &apiErr) || apiErr.Status != 400 {
+		t.Errorf("expected text fields to have no stats, got %v", err)
+	}
+
+	// documents
+	doc, err := c.Document(ctx, "21st_amendment_brewery_cafe-21a_ipa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Fields["name"] != "21A IPA" {
+		t.Errorf("expected 21A IPA, got %+v", doc)
+	}
+	err = c.IndexDocument(ctx, "test-lager", map[string]interface{}{"name": "Test Lager", "type": "beer", "abv": 4.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := c.Document(ctx, "test-lager"); err != nil || doc.Fields["name"] != "Test Lager" {
+		t.Errorf("expected the new document, got %+v, %v", doc, err)
+	}
+	rows, err := c.Debug(ctx, "test-lager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		t.Error("expected index rows for the new document")
+	}
+	if err := c.DeleteDocument(ctx, "test-lager"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Document(ctx, "test-lager"); !errors.As(err, &apiErr) || apiErr.Status != 404 || apiErr.Code != "not_found" {
+		t.Errorf("expected the document to be gone, got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimits            = flag.String("rateLimits", "/api/search=20:40", "per-client rate limits, as comma separated route=requestsPerSecond:burst")
+	maxConcurrentSearches = flag.Int("maxConcurrentSearches", 16, "maximum number of searches run at once (0 for no limit)")
+	searchQueueLength     = flag.Int("searchQueue", 64, "maximum number of searches waiting to run")
+	searchQueueWait       = flag.Duration("searchQueueWait", 5*time.Second, "how long a search may wait to run")
+)
+
+// routeLimit is the rate limit for one route: each client may make rate
+// requests per second on average, and up to burst at once.
+type routeLimit struct {
+	rate  float64
+	burst int
+}
+
+// parseRateLimits parses the -rateLimits flag into limits by route.
+func parseRateLimits(s string) (map[string]routeLimit, error) {
+	rv := map[string]routeLimit{}
+	if s == "" {
+		return rv, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		route, limit, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q is not route=rate:burst", spec)
+		}
+		rateStr, burstStr, ok := strings.Cut(limit, ":")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q is not route=rate:burst", spec)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("rate limit %q has an invalid rate", spec)
+		}
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("rate limit %q has an invalid burst", spec)
+		}
+		rv[route] = routeLimit{rate: rate, burst: burst}
+	}
+	return rv, nil
+}
+
+// tokenBucket holds the tokens left for one client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client for one route. A client is
+// identified by its API key, or its IP address if it didn't send one.
+type rateLimiter struct {
+	limit routeLimit
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit routeLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from client's bucket. If there are none, it
+// returns false and how long until there will be.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.burst), last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(float64(l.limit.burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets clients whose buckets have refilled, about once a
+// minute, so the map doesn't grow without bound.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	full := time.Duration(float64(l.limit.burst) / l.limit.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// clientID identifies the client making req for rate limiting.
+func clientID(req *http.Request) string {
+	if id := requestKeyID(req); id != "" {
+		return "key:" + id
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// wrap rejects requests over the limit with 429 Too Many Requests.
+func (l *rateLimiter) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ok, wait := l.allow(clientID(req), time.Now())
+		if !ok {
+			showTooManyRequests(w, req, "rate limit exceeded", wait)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// concurrencyLimiter caps how many requests run at once. Requests over
+// the cap wait in a queue of bounded length, for a bounded time.
+type concurrencyLimiter struct {
+	running chan struct{}
+	waiting chan struct{}
+	maxWait time.Duration
+}
+
+func newConcurrencyLimiter(max, queue int, maxWait time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		running: make(chan struct{}, max),
+		waiting: make(chan struct{}, queue),
+		maxWait: maxWait,
+	}
+}
+
+// acquire waits for a slot to run in, giving up if the queue is full,
+// the wait is too long or the client goes away. Call release when done.
+func (l *concurrencyLimiter) acquire(req *http.Request) bool {
+	select {
+	case l.running <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case l.waiting <- struct{}{}:
+		defer func() { <-l.waiting }()
+	default:
+		return false
+	}
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.running <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.running
+}
+
+// wrap rejects requests that can't get a slot with 429 Too Many
+// Requests. A nil *concurrencyLimiter doesn't limit anything.
+func (l *concurrencyLimiter) wrap(h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !l.acquire(req) {
+			showTooManyRequests(w, req, "too many searches in progress", time.Second)
+			return
+		}
+		defer l.release()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// limits applies the configured rate limit for each route, and the
+// concurrency limit to the routes that search.
+type limits struct {
+	routes   map[string]routeLimit
+	limiters map[string]*rateLimiter
+	searches *concurrencyLimiter
+}
+
+func newLimits(routes map[string]routeLimit, maxSearches, queue int, maxWait time.Duration) *limits {
+	l := &limits{
+		routes:   routes,
+		limiters: map[string]*rateLimiter{},
+	}
+	if maxSearches > 0 {
+		l.searches = newConcurrencyLimiter(maxSearches, queue, maxWait)
+	}
+	return l
+}
+
+// route wraps h, served at route, in the rate limit configured for it.
+// Every method on a route shares the same limit.
+func (l *limits) route(route string, h http.Handler) http.Handler {
+	limit, ok := l.routes[route]
+	if !ok {
+		return h
+	}
+	limiter, ok := l.limiters[route]
+	if !ok {
+		limiter = newRateLimiter(limit)
+		l.limiters[route] = limiter
+	}
+	return limiter.wrap(h)
+}
+
+// search wraps h, served at route, in both the route's rate limit and
+// the cap on concurrent searches.
+func (l *limits) search(route string, h http.Handler) http.Handler {
+	return l.route(route, l.searches.wrap(h))
+}
+
+func showTooManyRequests(w http.ResponseWriter, req *http.Request, msg string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	showError(w, req, msg, http.StatusTooManyRequests)
+}
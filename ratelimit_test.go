@@ -0,0 +1,136 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	routes, err := parseRateLimits("/api/search=2.5:10, /api/fields=1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes["/api/search"] != (routeLimit{rate: 2.5, burst: 10}) {
+		t.Errorf("unexpected search limit %+v", routes["/api/search"])
+	}
+	if routes["/api/fields"] != (routeLimit{rate: 1, burst: 1}) {
+		t.Errorf("unexpected fields limit %+v", routes["/api/fields"])
+	}
+
+	for _, bad := range []string{"/api/search", "/api/search=1", "/api/search=x:1", "/api/search=1:0", "/api/search=-1:1"} {
+		if _, err := parseRateLimits(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(routeLimit{rate: 2, burst: 3})
+	now := time.Now()
+
+	// the burst is allowed straight away, then clients wait for tokens
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d of burst refused", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatalf("expected request over burst to be refused")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %v", wait)
+	}
+
+	// other clients have their own buckets
+	if ok, _ := l.allow("b", now); !ok {
+		t.Errorf("expected another client to be allowed")
+	}
+
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("expected a request once a token was added")
+	}
+}
+
+func TestRateLimitedRoute(t *testing.T) {
+	routes := map[string]routeLimit{"/api/search": {rate: 1, burst: 1}}
+	lim := newLimits(routes, 0, 0, 0)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	h := lim.route("/api/search", ok)
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/search", nil))
+		if rec.Code != status {
+			t.Errorf("request %d: expected status %d, got %d", i, status, rec.Code)
+		}
+		if status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("expected Retry-After: 1, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+
+	if h := lim.route("/api/fields", ok); h == nil {
+		t.Errorf("expected unlimited route to be served")
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := newConcurrencyLimiter(1, 1, 50*time.Millisecond)
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-finish
+	}))
+
+	// the first search runs, the second waits in the queue, and the third
+	// finds the queue full
+	running := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/search", nil))
+		running <- rec.Code
+	}()
+	<-started
+
+	queued := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/search", nil))
+		queued <- rec.Code
+	}()
+	for len(l.waiting) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/search", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected search over the queue to be refused, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected Retry-After header")
+	}
+
+	// the queued search gives up after waiting too long
+	if code := <-queued; code != http.StatusTooManyRequests {
+		t.Errorf("expected queued search to time out, got %d", code)
+	}
+
+	close(finish)
+	if code := <-running; code != http.StatusOK {
+		t.Errorf("expected running search to succeed, got %d", code)
+	}
+}
@@ -0,0 +1,486 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+// smokeQueries are run against a rebuilt index before it is swapped in;
+// each must match at least one document.
+var smokeQueries = []string{
+	"type:beer",
+	"name:brewing",
+	"name:ale",
+	"abv:>5",
+}
+
+var errIndexBusy = errors.New("index is already being built")
+
+// activeIndexPath returns the path of the index to serve for the -index
+// path base. After a reindex this is a versioned path recorded in a
+// pointer file next to base; before any reindex it is base itself.
+func activeIndexPath(base string) (string, error) {
+	b, err := os.ReadFile(base + ".current")
+	if os.IsNotExist(err) {
+		return base, nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// previousIndexPath returns the path of the index kept for rollback for
+// base, recorded in a pointer file next to the active one, or "" if
+// there is none.
+func previousIndexPath(base string) (string, error) {
+	b, err := os.ReadFile(base + ".previous")
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// setActiveIndexPath records path as the index to serve for base, and
+// previous as the one to roll back to.
+func setActiveIndexPath(base, path, previous string) error {
+	// the active pointer is written last, so that an interrupted swap
+	// leaves the old one in place
+	if err := writePointer(base+".previous", previous); err != nil {
+		return err
+	}
+	return writePointer(base+".current", path)
+}
+
+// writePointer atomically replaces the pointer file name with path.
+func writePointer(name, path string) error {
+	tmp := name + ".tmp"
+	err := os.WriteFile(tmp, []byte(path+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// reindexStatus describes the most recent reindex or rollback.
+type reindexStatus struct {
+	State    string    `json:"state"`
+	Path     string    `json:"path,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// liveIndex is the index served under a bleve HTTP index name. The name
+// is registered to an alias of the one current index, so that a rebuilt
+// index can be swapped in atomically while searches continue. The index
+// it replaces is kept on disk for rollback.
+type liveIndex struct {
+	name  string
+	base  string
+	alias bleve.IndexAlias
+	saved *savedSearches
+	wg    sync.WaitGroup
+
+	// inUse is held for reading while the current index is used outside
+	// the alias, and for writing while it is swapped out and closed
+	inUse sync.RWMutex
+
+	mutex        sync.Mutex
+	current      bleve.Index
+	currentPath  string
+	previousPath string
+	busy         bool
+	replacing    bool
+	status       reindexStatus
+}
+
+// newLiveIndex registers idx, opened from path, under name. base is the
+// -index path, used to place and record rebuilt indexes, and to find the
+// index kept for rollback by an earlier run. Documents written through
+// the name or by reindexing are checked against saved.
+func newLiveIndex(name, base string, idx bleve.Index, path string, saved *savedSearches) *liveIndex {
+	previous, err := previousIndexPath(base)
+	if err != nil {
+		log.Printf("error finding the index kept for rollback: %v", err)
+	}
+	if previous == path {
+		previous = ""
+	}
+	l := &liveIndex{
+		name:         name,
+		base:         base,
+		alias:        bleve.NewIndexAlias(idx),
+		saved:        saved,
+		current:      idx,
+		currentPath:  path,
+		previousPath: previous,
+		status:       reindexStatus{State: "idle", Path: path, Previous: previous},
+	}
+	bleveHttp.RegisterIndexName(name, changeTrackingIndex{l.alias, saved})
+	l.registerShards(idx, nil)
+	return l
+}
+
+// registerShards registers each shard of idx under its own name, for
+// handlers that only work on a single index, replacing the names of the
+// shards of old.
+func (l *liveIndex) registerShards(idx, old bleve.Index) {
+	shards := indexShards(idx)
+	if len(shards) > 1 {
+		for n, shard := range shards {
+			bleveHttp.RegisterIndexName(fmt.Sprintf("%s/%d", l.name, n), shard)
+		}
+	} else {
+		shards = nil
+	}
+	if old != nil {
+		for n := len(shards); n < len(indexShards(old)); n++ {
+			bleveHttp.UnregisterIndexByName(fmt.Sprintf("%s/%d", l.name, n))
+		}
+	}
+}
+
+// shardNameLookup returns the registered name of the shard that owns the
+// document in the request, or "" if the index is not sharded.
+func (l *liveIndex) shardNameLookup(req *http.Request) string {
+	shards := indexShards(l.Current())
+	if len(shards) == 1 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", l.name, shardFor(docIDLookup(req), len(shards)))
+}
+
+// changeTrackingIndex notes every write made through the HTTP handlers,
+// which find the index by its registered name, and checks the documents
+// indexed against the saved searches. Batches aren't checked, as their
+// document IDs can't be read back, but the handlers don't make any.
+type changeTrackingIndex struct {
+	bleve.IndexAlias
+	saved *savedSearches
+}
+
+func (c changeTrackingIndex) Index(id string, data interface{}) error {
+	defer indexChanged()
+	if err := c.IndexAlias.Index(id, data); err != nil {
+		return err
+	}
+	c.saved.check(c.IndexAlias, []string{id}, nil)
+	return nil
+}
+
+func (c changeTrackingIndex) Delete(id string) error {
+	defer indexChanged()
+	return c.IndexAlias.Delete(id)
+}
+
+func (c changeTrackingIndex) Batch(b *bleve.Batch) error {
+	defer indexChanged()
+	return c.IndexAlias.Batch(b)
+}
+
+// Current returns the index currently being served.
+func (l *liveIndex) Current() bleve.Index {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.current
+}
+
+// Use calls f with the current index, which isn't swapped out and
+// closed until f returns.
+func (l *liveIndex) Use(f func(bleve.Index) error) error {
+	l.inUse.RLock()
+	defer l.inUse.RUnlock()
+	return f(l.Current())
+}
+
+// Status returns the state of the most recent reindex or rollback.
+func (l *liveIndex) Status() reindexStatus {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.status
+}
+
+// acquire marks the index busy, so that only one build, reindex or
+// rollback runs at a time. It returns errIndexBusy if one already is.
+func (l *liveIndex) acquire() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.busy {
+		return errIndexBusy
+	}
+	l.busy = true
+	return nil
+}
+
+func (l *liveIndex) release() {
+	l.mutex.Lock()
+	l.busy = false
+	l.mutex.Unlock()
+}
+
+// Reindex starts building a new index from the data directory under a
+// versioned path, in the background. If it is complete and passes the
+// smoke queries, it replaces the current index. Cancelling ctx abandons
+// the new index.
+func (l *liveIndex) Reindex(ctx context.Context) error {
+	if err := l.acquire(); err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s.%s", l.base, time.Now().UTC().Format("20060102T150405"))
+	l.mutex.Lock()
+	l.status = reindexStatus{State: "indexing", Path: path, Started: time.Now()}
+	l.replacing = true
+	l.mutex.Unlock()
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		defer l.release()
+
+		err := l.rebuild(ctx, path)
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.replacing = false
+		l.status.Finished = time.Now()
+		if err != nil {
+			log.Printf("Reindex to %s failed: %v", path, err)
+			l.status.State = "failed"
+			l.status.Error = err.Error()
+			return
+		}
+		l.status.State = "done"
+		l.status.Previous = l.previousPath
+	}()
+	return nil
+}
+
+func (l *liveIndex) rebuild(ctx context.Context, path string) error {
+	log.Printf("Reindexing into %s...", path)
+	indexMapping, err := buildIndexMapping()
+	if err != nil {
+		return err
+	}
+	idx, err := newIndex(path, indexMapping, *shardCount)
+	if err != nil {
+		return err
+	}
+
+	// only documents that didn't match in the index being replaced are
+	// new matches
+	count, err := indexBeer(ctx, idx, func(ids []string) {
+		l.saved.check(idx, ids, l.Current())
+	})
+	if err == nil {
+		l.mutex.Lock()
+		l.status.State = "verifying"
+		l.mutex.Unlock()
+		err = verifyIndex(idx, uint64(count))
+	}
+	if err != nil {
+		idx.Close()
+		os.RemoveAll(path)
+		return err
+	}
+
+	return l.swap(idx, path)
+}
+
+// Rollback puts the index replaced by the last reindex or rollback back
+// into service.
+func (l *liveIndex) Rollback() error {
+	if err := l.acquire(); err != nil {
+		return err
+	}
+	defer l.release()
+
+	l.mutex.Lock()
+	path := l.previousPath
+	l.replacing = true
+	l.mutex.Unlock()
+	defer func() {
+		l.mutex.Lock()
+		l.replacing = false
+		l.mutex.Unlock()
+	}()
+	if path == "" {
+		return fmt.Errorf("no previous index to roll back to")
+	}
+
+	idx, err := openIndex(path)
+	if err != nil {
+		return err
+	}
+	err = l.swap(idx, path)
+	if err != nil {
+		idx.Close()
+		return err
+	}
+
+	l.mutex.Lock()
+	l.status = reindexStatus{
+		State:    "rolled back",
+		Path:     path,
+		Previous: l.previousPath,
+		Finished: time.Now(),
+	}
+	l.mutex.Unlock()
+	return nil
+}
+
+// swap makes idx, opened from path, the current index. The replaced
+// index is closed and becomes the rollback target; the one before it, if
+// any, is deleted.
+func (l *liveIndex) swap(idx bleve.Index, path string) error {
+	l.inUse.Lock()
+	defer l.inUse.Unlock()
+	l.mutex.Lock()
+	oldPath := l.currentPath
+	l.mutex.Unlock()
+	err := setActiveIndexPath(l.base, path, oldPath)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	old, stale := l.current, l.previousPath
+	l.alias.Swap([]bleve.Index{idx}, []bleve.Index{old})
+	l.registerShards(idx, old)
+	l.current, l.currentPath, l.previousPath = idx, path, oldPath
+	l.mutex.Unlock()
+	indexChanged()
+	log.Printf("Now serving %s, previous index %s kept for rollback", path, oldPath)
+
+	// the swap waits for searches on the alias, and inUse for everything
+	// else, so nothing uses old now
+	if err := old.Close(); err != nil {
+		log.Printf("error closing %s: %v", oldPath, err)
+	}
+	if stale != "" && stale != path {
+		log.Printf("Removing %s", stale)
+		if err := os.RemoveAll(stale); err != nil {
+			log.Printf("error removing %s: %v", stale, err)
+		}
+	}
+	return nil
+}
+
+// Close waits for any reindex to finish and closes the current index.
+func (l *liveIndex) Close() error {
+	l.wg.Wait()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.alias.Close()
+	return l.current.Close()
+}
+
+// verifyIndex checks that idx holds the expected number of documents and
+// that each of the smoke queries finds something.
+func verifyIndex(idx bleve.Index, expected uint64) error {
+	count, err := idx.DocCount()
+	if err != nil {
+		return err
+	}
+	if count != expected {
+		return fmt.Errorf("expected %d documents, index has %d", expected, count)
+	}
+
+	for _, q := range smokeQueries {
+		req := bleve.NewSearchRequestOptions(bleve.NewQueryStringQuery(q), 0, 0, false)
+		res, err := idx.Search(req)
+		if err != nil {
+			return fmt.Errorf("smoke query %q: %v", q, err)
+		}
+		if res.Total == 0 {
+			return fmt.Errorf("smoke query %q matched nothing", q)
+		}
+	}
+	return nil
+}
+
+// refuseWhileReplacing wraps h, which writes to the index, so that it
+// refuses requests while a reindex or rollback is replacing the index,
+// as what it wrote would be lost in the swap.
+func (l *liveIndex) refuseWhileReplacing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		l.mutex.Lock()
+		replacing := l.replacing
+		l.mutex.Unlock()
+		if replacing {
+			showError(w, req, "the index is being replaced, try again when the reindex or rollback is done", 409)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// reindexHandler starts a reindex on POST and reports on the latest one
+// on GET.
+type reindexHandler struct {
+	ctx  context.Context
+	live *liveIndex
+}
+
+func newReindexHandler(ctx context.Context, live *liveIndex) *reindexHandler {
+	return &reindexHandler{
+		ctx:  ctx,
+		live: live,
+	}
+}
+
+func (h *reindexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		err := h.live.Reindex(h.ctx)
+		if err == errIndexBusy {
+			showError(w, req, err.Error(), 409)
+			return
+		}
+	}
+	mustEncode(w, h.live.Status())
+}
+
+// rollbackHandler swaps the previous index back in.
+type rollbackHandler struct {
+	live *liveIndex
+}
+
+func newRollbackHandler(live *liveIndex) *rollbackHandler {
+	return &rollbackHandler{
+		live: live,
+	}
+}
+
+func (h *rollbackHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := h.live.Rollback()
+	if err == errIndexBusy {
+		showError(w, req, err.Error(), 409)
+		return
+	} else if err != nil {
+		showError(w, req, fmt.Sprintf("error rolling back: %v", err), 500)
+		return
+	}
+	mustEncode(w, h.live.Status())
+}
@@ -0,0 +1,144 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+func TestReindexAndRollback(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// reindex from a small copy of the data
+	useTestData(t, 200)
+
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(tempDir, "beer-search.bleve")
+	index, err := bleve.New(base, mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexTestBeer(t, index, 10)
+
+	live := newLiveIndex("beer-reindex-test", base, index, base, nil)
+	defer bleveHttp.UnregisterIndexByName("beer-reindex-test")
+
+	err = live.Reindex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := live.Reindex(context.Background()); err != errIndexBusy {
+		t.Errorf("expected second reindex to be refused, got %v", err)
+	}
+
+	// writes, which would be lost in the swap, are refused meanwhile
+	written := 0
+	write := live.refuseWhileReplacing(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		written++
+	}))
+	rec := httptest.NewRecorder()
+	write.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/doc/x", nil))
+	if rec.Code != http.StatusConflict || written != 0 {
+		t.Errorf("expected the write to be refused during the reindex, got %d", rec.Code)
+	}
+	live.wg.Wait()
+	rec = httptest.NewRecorder()
+	write.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/doc/x", nil))
+	if rec.Code != http.StatusOK || written != 1 {
+		t.Errorf("expected the write after the reindex to be made, got %d", rec.Code)
+	}
+
+	status := live.Status()
+	if status.State != "done" {
+		t.Fatalf("expected reindex to be done, got %+v", status)
+	}
+	if status.Previous != base {
+		t.Errorf("expected previous index %s, got %s", base, status.Previous)
+	}
+	active, err := activeIndexPath(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active != status.Path {
+		t.Errorf("expected active index %s, got %s", status.Path, active)
+	}
+
+	// searches through the registered name see the new index
+	count, err := bleveHttp.IndexByName("beer-reindex-test").DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 200 {
+		t.Errorf("expected 200 documents after reindex, got %d", count)
+	}
+
+	// the index to roll back to is remembered across a restart
+	if err := live.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = openIndex(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live = newLiveIndex("beer-reindex-test", base, index, active, nil)
+	defer live.Close()
+	if status := live.Status(); status.Previous != base {
+		t.Errorf("expected previous index %s after a restart, got %s", base, status.Previous)
+	}
+
+	err = live.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = bleveHttp.IndexByName("beer-reindex-test").DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Errorf("expected 10 documents after rollback, got %d", count)
+	}
+	active, err = activeIndexPath(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active != base {
+		t.Errorf("expected active index %s after rollback, got %s", base, active)
+	}
+}
+
+func TestVerifyIndex(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 200)
+
+	if err := verifyIndex(index, 200); err != nil {
+		t.Error(err)
+	}
+	if err := verifyIndex(index, 201); err == nil {
+		t.Errorf("expected a document count mismatch to fail verification")
+	}
+}
@@ -0,0 +1,518 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// savedMatchesKept is how many of the most recent matches each saved
+// search keeps in its feed.
+const savedMatchesKept = 1000
+
+// savedMatch is an entry in the feed of a saved search: a document that
+// matched it when it was indexed. Seq numbers the matches of a search in
+// order, so clients can ask for the ones since the last they saw.
+type savedMatch struct {
+	Seq  uint64    `json:"seq"`
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// savedSearch is a named query that indexed documents are checked
+// against, with the feed of those that matched.
+type savedSearch struct {
+	Name    string          `json:"name"`
+	Query   json.RawMessage `json:"query"`
+	Webhook string          `json:"webhook,omitempty"`
+	Created time.Time       `json:"created"`
+	NextSeq uint64          `json:"next_seq"`
+	Matches []savedMatch    `json:"matches"`
+
+	query query.Query
+}
+
+// webhookCall is a notification of new matches to send to a webhook.
+type webhookCall struct {
+	url     string
+	Search  string       `json:"search"`
+	Matches []savedMatch `json:"matches"`
+}
+
+// savedSearches holds the saved searches, stored in a JSON file next to
+// the index. Every write path calls check with the documents it indexed,
+// and any that match a saved search are added to its feed, and sent to
+// its webhook if it has one. A nil *savedSearches checks nothing.
+type savedSearches struct {
+	path string
+
+	mutex    sync.Mutex
+	searches map[string]*savedSearch
+	closed   bool
+
+	webhooks chan webhookCall
+	client   *http.Client
+	done     chan struct{}
+}
+
+// loadSavedSearches reads the saved searches from path, if it exists.
+func loadSavedSearches(path string) (*savedSearches, error) {
+	s := &savedSearches{
+		path:     path,
+		searches: map[string]*savedSearch{},
+		webhooks: make(chan webhookCall, 100),
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			// a redirect could lead off this machine
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		done: make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var file struct {
+			Searches []*savedSearch `json:"searches"`
+		}
+		if err := json.Unmarshal(b, &file); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		for _, ss := range file.Searches {
+			q, qErr := parseValidateQuery(ss.Query)
+			if qErr != nil {
+				return nil, fmt.Errorf("error in %s: saved search '%s': %s", path, ss.Name, qErr.Message)
+			}
+			ss.query = q
+			s.searches[ss.Name] = ss
+		}
+	}
+
+	go s.sendWebhooks()
+	return s, nil
+}
+
+// Close stops sending webhooks. Calls already queued are dropped.
+func (s *savedSearches) Close() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// save writes the saved searches out. The caller must hold the mutex.
+func (s *savedSearches) save() error {
+	file := struct {
+		Searches []*savedSearch `json:"searches"`
+	}{
+		Searches: s.sorted(),
+	}
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// sorted returns the saved searches by name. The caller must hold the
+// mutex.
+func (s *savedSearches) sorted() []*savedSearch {
+	rv := make([]*savedSearch, 0, len(s.searches))
+	for _, ss := range s.searches {
+		rv = append(rv, ss)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv
+}
+
+// put saves a search, replacing any of the same name along with its
+// feed.
+func (s *savedSearches) put(ss *savedSearch) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.searches[ss.Name] = ss
+	return s.save()
+}
+
+// remove deletes the named search, reporting whether there was one.
+func (s *savedSearches) remove(name string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.searches[name]; !ok {
+		return false, nil
+	}
+	delete(s.searches, name)
+	return true, s.save()
+}
+
+// get returns a copy of the named search, with only the matches after
+// seq, or nil if there is no such search.
+func (s *savedSearches) get(name string, since uint64) *savedSearch {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ss, ok := s.searches[name]
+	if !ok {
+		return nil
+	}
+	rv := *ss
+	rv.Matches = []savedMatch{}
+	for _, match := range ss.Matches {
+		if match.Seq > since {
+			rv.Matches = append(rv.Matches, match)
+		}
+	}
+	return &rv
+}
+
+// check runs each saved search on the documents ids just written to idx,
+// and records the matches. When idx is a rebuild of previous, only the
+// documents that didn't already match in previous are recorded, so that
+// rebuilding doesn't repeat every match.
+func (s *savedSearches) check(idx bleve.Index, ids []string, previous bleve.Index) {
+	if s == nil || len(ids) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	searches := s.sorted()
+	s.mutex.Unlock()
+
+	found := map[*savedSearch][]string{}
+	for _, ss := range searches {
+		matched, err := matchingIDs(idx, ss.query, ids)
+		if err == nil && previous != nil && len(matched) > 0 {
+			var before []string
+			before, err = matchingIDs(previous, ss.query, matched)
+			matched = subtractIDs(matched, before)
+		}
+		if err != nil {
+			log.Printf("error checking saved search '%s': %v", ss.Name, err)
+			continue
+		}
+		if len(matched) > 0 {
+			found[ss] = matched
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now().UTC()
+	for ss, matched := range found {
+		if s.searches[ss.Name] != ss {
+			// deleted or replaced while checking
+			continue
+		}
+		var matches []savedMatch
+		for _, id := range matched {
+			ss.NextSeq++
+			matches = append(matches, savedMatch{Seq: ss.NextSeq, ID: id, Time: now})
+		}
+		ss.Matches = append(ss.Matches, matches...)
+		if len(ss.Matches) > savedMatchesKept {
+			ss.Matches = append([]savedMatch(nil), ss.Matches[len(ss.Matches)-savedMatchesKept:]...)
+		}
+		if ss.Webhook != "" && !s.closed {
+			select {
+			case s.webhooks <- webhookCall{url: ss.Webhook, Search: ss.Name, Matches: matches}:
+			default:
+				log.Printf("webhook queue full, dropped %d matches of saved search '%s'", len(matches), ss.Name)
+			}
+		}
+	}
+	if err := s.save(); err != nil {
+		log.Printf("error saving saved searches: %v", err)
+	}
+}
+
+// matchingIDs returns which of the documents ids match q in idx.
+func matchingIDs(idx bleve.Index, q query.Query, ids []string) ([]string, error) {
+	sr := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(q, bleve.NewDocIDQuery(ids)), len(ids), 0, false)
+	sr.SortBy([]string{"_id"})
+	searchResponse, err := idx.Search(sr)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]string, len(searchResponse.Hits))
+	for n, hit := range searchResponse.Hits {
+		rv[n] = hit.ID
+	}
+	return rv, nil
+}
+
+func subtractIDs(ids, remove []string) []string {
+	removed := map[string]bool{}
+	for _, id := range remove {
+		removed[id] = true
+	}
+	var rv []string
+	for _, id := range ids {
+		if !removed[id] {
+			rv = append(rv, id)
+		}
+	}
+	return rv
+}
+
+// sendWebhooks posts the queued webhook calls, one at a time, until
+// Close is called.
+func (s *savedSearches) sendWebhooks() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case call := <-s.webhooks:
+			b, err := json.Marshal(call)
+			if err != nil {
+				log.Printf("error encoding webhook for saved search '%s': %v", call.Search, err)
+				continue
+			}
+			resp, err := s.client.Post(call.url, "application/json", bytes.NewReader(b))
+			if err != nil {
+				log.Printf("error calling webhook for saved search '%s': %v", call.Search, err)
+				continue
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Printf("webhook for saved search '%s' returned %s", call.Search, resp.Status)
+			}
+		}
+	}
+}
+
+// checkWebhookURL makes sure a webhook is an http or https URL on this
+// machine, so that saved searches can't be used to make requests to
+// other hosts.
+func checkWebhookURL(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook '%s' is not an http or https URL", webhook)
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("webhook '%s' is not on localhost", webhook)
+	}
+	return nil
+}
+
+func savedSearchNameLookup(req *http.Request) string {
+	return muxVariableLookup(req, "name")
+}
+
+// savedSearchSummary describes a saved search without its feed.
+type savedSearchSummary struct {
+	Name    string          `json:"name"`
+	Query   json.RawMessage `json:"query"`
+	Webhook string          `json:"webhook,omitempty"`
+	Created time.Time       `json:"created"`
+	Matched uint64          `json:"matched"`
+}
+
+func summarize(ss *savedSearch) savedSearchSummary {
+	return savedSearchSummary{
+		Name:    ss.Name,
+		Query:   ss.Query,
+		Webhook: ss.Webhook,
+		Created: ss.Created,
+		Matched: ss.NextSeq,
+	}
+}
+
+// savedSearchesHandler lists the saved searches.
+type savedSearchesHandler struct {
+	saved *savedSearches
+}
+
+func newSavedSearchesHandler(saved *savedSearches) *savedSearchesHandler {
+	return &savedSearchesHandler{
+		saved: saved,
+	}
+}
+
+func (h *savedSearchesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.saved.mutex.Lock()
+	searches := []savedSearchSummary{}
+	for _, ss := range h.saved.sorted() {
+		searches = append(searches, summarize(ss))
+	}
+	h.saved.mutex.Unlock()
+
+	rv := struct {
+		Searches []savedSearchSummary `json:"searches"`
+	}{
+		Searches: searches,
+	}
+	mustEncode(w, rv)
+}
+
+// savedSearchHandler shows (GET), saves (PUT) or deletes (DELETE) one
+// saved search. The body of a PUT has the query, as a query string or a
+// query object, and optionally a webhook URL on localhost to notify of
+// matches. Saving a search again starts a new feed.
+type savedSearchHandler struct {
+	saved *savedSearches
+}
+
+func newSavedSearchHandler(saved *savedSearches) *savedSearchHandler {
+	return &savedSearchHandler{
+		saved: saved,
+	}
+}
+
+func (h *savedSearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := savedSearchNameLookup(req)
+
+	switch req.Method {
+	case "PUT":
+		requestBody, err := io.ReadAll(req.Body)
+		if err != nil {
+			showError(w, req, fmt.Sprintf("error reading request body: %v", err), 400)
+			return
+		}
+		var putRequest struct {
+			Query   json.RawMessage `json:"query"`
+			Webhook string          `json:"webhook"`
+		}
+		if err := json.Unmarshal(requestBody, &putRequest); err != nil {
+			showError(w, req, fmt.Sprintf("error parsing request: %v", err), 400)
+			return
+		}
+		if len(putRequest.Query) == 0 {
+			showError(w, req, "a query is required", 400)
+			return
+		}
+		q, qErr := parseValidateQuery(putRequest.Query)
+		if qErr != nil {
+			msg := qErr.Message
+			if qErr.Position != nil {
+				msg += " at position " + strconv.Itoa(*qErr.Position)
+			}
+			showErrorDetails(w, req, fmt.Sprintf("error parsing query: %s", msg), 400, codeInvalidQuery, qErr)
+			return
+		}
+		if putRequest.Webhook != "" {
+			if err := checkWebhookURL(putRequest.Webhook); err != nil {
+				showError(w, req, err.Error(), 400)
+				return
+			}
+		}
+
+		ss := &savedSearch{
+			Name:    name,
+			Query:   putRequest.Query,
+			Webhook: putRequest.Webhook,
+			Created: time.Now().UTC(),
+			Matches: []savedMatch{},
+			query:   q,
+		}
+		if err := h.saved.put(ss); err != nil {
+			showError(w, req, fmt.Sprintf("error saving search: %v", err), 500)
+			return
+		}
+		mustEncode(w, summarize(ss))
+
+	case "DELETE":
+		found, err := h.saved.remove(name)
+		if err != nil {
+			showError(w, req, fmt.Sprintf("error saving searches: %v", err), 500)
+			return
+		}
+		if !found {
+			showError(w, req, fmt.Sprintf("no saved search '%s'", name), 404)
+			return
+		}
+		rv := struct {
+			Status string `json:"status"`
+		}{
+			Status: "ok",
+		}
+		mustEncode(w, rv)
+
+	default:
+		ss := h.saved.get(name, 0)
+		if ss == nil {
+			showError(w, req, fmt.Sprintf("no saved search '%s'", name), 404)
+			return
+		}
+		mustEncode(w, summarize(ss))
+	}
+}
+
+// savedMatchesHandler serves the feed of a saved search: the documents
+// that matched it, oldest first, after the seq given by the since
+// parameter.
+type savedMatchesHandler struct {
+	saved *savedSearches
+}
+
+func newSavedMatchesHandler(saved *savedSearches) *savedMatchesHandler {
+	return &savedMatchesHandler{
+		saved: saved,
+	}
+}
+
+func (h *savedMatchesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := savedSearchNameLookup(req)
+	var since uint64
+	if sinceStr := req.FormValue("since"); sinceStr != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			showError(w, req, fmt.Sprintf("invalid since '%s'", sinceStr), 400)
+			return
+		}
+	}
+
+	ss := h.saved.get(name, since)
+	if ss == nil {
+		showError(w, req, fmt.Sprintf("no saved search '%s'", name), 404)
+		return
+	}
+	rv := struct {
+		Name    string       `json:"name"`
+		Matches []savedMatch `json:"matches"`
+		LastSeq uint64       `json:"last_seq"`
+	}{
+		Name:    ss.Name,
+		Matches: ss.Matches,
+		LastSeq: ss.NextSeq,
+	}
+	mustEncode(w, rv)
+}
@@ -0,0 +1,141 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gorilla/mux"
+)
+
+func TestSavedSearches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "beer-search.bleve.saved.json")
+	saved, err := loadSavedSearches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+
+	hooks := make(chan webhookCall, 10)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var call webhookCall
+		if err := json.NewDecoder(req.Body).Decode(&call); err != nil {
+			t.Error(err)
+		}
+		hooks <- call
+	}))
+	defer hookServer.Close()
+
+	router := mux.NewRouter()
+	router.Handle("/api/saved", newSavedSearchesHandler(saved))
+	router.Handle("/api/saved/{name}", newSavedSearchHandler(saved))
+	router.Handle("/api/saved/{name}/matches", newSavedMatchesHandler(saved))
+	do := func(method, url, body string, code int) []byte {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		if rec.Code != code {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, url, code, rec.Code, rec.Body)
+		}
+		return rec.Body.Bytes()
+	}
+
+	do("PUT", "/api/saved/strong", `{"query": "+type:beer +abv:>8", "webhook": "`+hookServer.URL+`"}`, 200)
+	do("PUT", "/api/saved/bad", `{"query": "abv:>"}`, 400)
+	do("PUT", "/api/saved/remote", `{"query": "abv:>8", "webhook": "http://example.com/hook"}`, 400)
+	do("GET", "/api/saved/bad", "", 404)
+
+	// nor can a webhook redirect elsewhere
+	redirector := httptest.NewServer(http.RedirectHandler("http://example.com/hook", http.StatusFound))
+	defer redirector.Close()
+	resp, err := saved.client.Post(redirector.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected the redirect not to be followed, got %s", resp.Status)
+	}
+
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tracked := changeTrackingIndex{IndexAlias: bleve.NewIndexAlias(index), saved: saved}
+
+	// documents written through the index are checked as they are indexed
+	if err := tracked.Index("quad", map[string]interface{}{"type": "beer", "name": "Quad", "abv": 11.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracked.Index("light", map[string]interface{}{"type": "beer", "name": "Light", "abv": 3.2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var feed struct {
+		Matches []savedMatch `json:"matches"`
+		LastSeq uint64       `json:"last_seq"`
+	}
+	if err := json.Unmarshal(do("GET", "/api/saved/strong/matches", "", 200), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Matches) != 1 || feed.Matches[0].ID != "quad" || feed.Matches[0].Seq != 1 || feed.LastSeq != 1 {
+		t.Errorf("expected quad to be match 1, got %+v", feed)
+	}
+
+	select {
+	case call := <-hooks:
+		if call.Search != "strong" || len(call.Matches) != 1 || call.Matches[0].ID != "quad" {
+			t.Errorf("expected a webhook call for quad, got %+v", call)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected a webhook call")
+	}
+
+	// a rebuilt index only adds documents that didn't match before
+	rebuilt, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebuilt.Close()
+	for id, abv := range map[string]float64{"quad": 11.5, "light": 9.0, "new": 10.0} {
+		if err := rebuilt.Index(id, map[string]interface{}{"type": "beer", "abv": abv}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved.check(rebuilt, []string{"quad", "light", "new"}, index)
+
+	// the feed is kept on disk
+	reloaded, err := loadSavedSearches(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	ss := reloaded.get("strong", 1)
+	if ss == nil || len(ss.Matches) != 2 || ss.Matches[0].ID != "light" || ss.Matches[1].ID != "new" {
+		t.Errorf("expected light and new after match 1, got %+v", ss)
+	}
+
+	do("DELETE", "/api/saved/strong", "", 200)
+	do("DELETE", "/api/saved/strong", "", 404)
+	if body := strings.TrimSpace(string(do("GET", "/api/saved", "", 200))); body != `{"searches":[]}` {
+		t.Errorf("expected no saved searches, got %s", body)
+	}
+}
@@ -0,0 +1,387 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/blevesearch/bleve/v2/search/searcher"
+)
+
+var searchTimeout = flag.Duration("searchTimeout", 30*time.Second, "maximum time a search may run")
+
+// searchHandler runs a bleve search request from the request body, like
+// bleve's own search handler, or for GET requests one built from the URL
+// parameters by searchRequestFromURL. It is bound to the request: the search
+// is cancelled if the client goes away, and stopped after maxTimeout, or
+// the shorter timeout request parameter.
+//
+// A search that times out is reported with 504 Gateway Timeout. When
+// only some shards time out, the hits from the rest are returned with
+// the failures listed in the response status, and an
+// X-Search-Timed-Out header.
+//
+// Hits are always sorted with the document ID as the last key, so that
+// every response can carry a next cursor, which the cursor parameter
+// takes to continue after the last hit.
+//
+// Complete results are kept in cache, if it isn't nil, until the index
+// changes.
+type searchHandler struct {
+	defaultIndexName string
+	maxTimeout       time.Duration
+	cache            *searchCache
+}
+
+// searchPage is a search response: bleve's result, plus the cursor for
+// the page after it.
+type searchPage struct {
+	*bleve.SearchResult
+	Next string `json:"next,omitempty"`
+}
+
+func newSearchHandler(defaultIndexName string, maxTimeout time.Duration, cache *searchCache) *searchHandler {
+	return &searchHandler{
+		defaultIndexName: defaultIndexName,
+		maxTimeout:       maxTimeout,
+		cache:            cache,
+	}
+}
+
+func (h *searchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	index := bleveHttp.IndexByName(h.defaultIndexName)
+	if index == nil {
+		showError(w, req, fmt.Sprintf("no such index '%s'", h.defaultIndexName), 404)
+		return
+	}
+
+	searchRequest, err := parseSearchRequest(req, index.Mapping())
+	if err != nil {
+		showQueryError(w, req, err, 400)
+		return
+	}
+
+	timeout, err := h.timeout(req)
+	if err != nil {
+		showError(w, req, err.Error(), 400)
+		return
+	}
+
+	info := requestInfoFrom(req.Context())
+	info.noteQuery(searchRequest.Query)
+
+	stableSort(searchRequest)
+	if cursor := req.FormValue("cursor"); cursor != "" {
+		if err := applyCursor(searchRequest, cursor); err != nil {
+			showError(w, req, err.Error(), 400)
+			return
+		}
+	}
+
+	cacheKey, err := searchCacheKey(h.defaultIndexName, searchRequest)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error encoding query: %v", err), 500)
+		return
+	}
+	if cached := h.cache.get(cacheKey); cached != nil {
+		info.noteHits(cached.hits)
+		writeCachedSearch(w, req, cached, "HIT")
+		return
+	}
+
+	// note the version first, so that a change during the search makes
+	// the result stale
+	version := indexVersion.Load()
+	searchResponse, timedOut, err := runSearch(req.Context(), index, searchRequest, timeout)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			// the client went away, so there is no one to answer
+			log.Printf("Search cancelled by client")
+			return
+		}
+		if timedOut {
+			showError(w, req, fmt.Sprintf("search timed out after %v", timeout), 504)
+			return
+		}
+		showQueryError(w, req, fmt.Errorf("error executing query: %w", err), 500)
+		return
+	}
+
+	info.noteHits(searchResponse.Total)
+
+	// encode the response, with the cursor for the next page
+	next, err := nextCursor(searchRequest, searchResponse)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error encoding cursor: %v", err), 500)
+		return
+	}
+	body, err := json.Marshal(searchPage{SearchResult: searchResponse, Next: next})
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error encoding response: %v", err), 500)
+		return
+	}
+	body = append(body, '\n')
+
+	cache := h.cache
+	if timedOut {
+		// partial results are not cached
+		w.Header().Set("X-Search-Timed-Out", "true")
+		cache = nil
+	}
+	writeCachedSearch(w, req, cache.put(cacheKey, version, body, searchResponse.Total), "MISS")
+}
+
+// parseSearchRequest reads the search request from the body of req, or
+// for GET from its URL, and validates the query against the index
+// mapping m.
+func parseSearchRequest(req *http.Request, m mapping.IndexMapping) (*bleve.SearchRequest, error) {
+	var searchRequest *bleve.SearchRequest
+	if req.Method == "GET" {
+		var err error
+		searchRequest, err = searchRequestFromURL(req.URL.Query())
+		if err != nil {
+			return nil, &invalidQueryError{msg: fmt.Sprintf("error parsing query: %v", err)}
+		}
+	} else {
+		// read the request body
+		requestBody, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %v", err)
+		}
+
+		// parse the request
+		err = json.Unmarshal(requestBody, &searchRequest)
+		if err != nil {
+			return nil, &invalidQueryError{msg: fmt.Sprintf("error parsing query: %v", err)}
+		}
+	}
+
+	// validate the query
+	if srqv, ok := searchRequest.Query.(query.ValidatableQuery); ok {
+		err := srqv.Validate()
+		if err != nil {
+			return nil, newInvalidQueryError("error validating query: ", searchRequest.Query, err)
+		}
+	}
+	if err := checkQuery(searchRequest.Query, m); err != nil {
+		return nil, newInvalidQueryError("error validating query: ", searchRequest.Query, err)
+	}
+	return searchRequest, nil
+}
+
+// checkQuery finds the mistakes in q that bleve's validation doesn't and
+// only reports once the search runs, without telling them apart from
+// the index failing: fuzziness out of range, and dates that the date
+// parser of the query or the mapping m can't read.
+func checkQuery(q query.Query, m mapping.IndexMapping) error {
+	checkFuzziness := func(fuzziness int) error {
+		if fuzziness < 0 || fuzziness > searcher.MaxFuzziness {
+			return fmt.Errorf("fuzziness %d is not from 0 to %d", fuzziness, searcher.MaxFuzziness)
+		}
+		return nil
+	}
+	checkAll := func(queries ...query.Query) error {
+		for _, q := range queries {
+			if err := checkQuery(q, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch q := q.(type) {
+	case *query.BooleanQuery:
+		return checkAll(q.Must, q.Should, q.MustNot)
+	case *query.ConjunctionQuery:
+		return checkAll(q.Conjuncts...)
+	case *query.DisjunctionQuery:
+		return checkAll(q.Disjuncts...)
+	case *query.QueryStringQuery:
+		// syntax errors were found by validation
+		if parsed, err := q.Parse(); err == nil {
+			return checkQuery(parsed, m)
+		}
+	case *query.MatchQuery:
+		return checkFuzziness(q.Fuzziness)
+	case *query.MatchPhraseQuery:
+		return checkFuzziness(q.Fuzziness)
+	case *query.PhraseQuery:
+		return checkFuzziness(q.Fuzziness)
+	case *query.MultiPhraseQuery:
+		return checkFuzziness(q.Fuzziness)
+	case *query.FuzzyQuery:
+		return checkFuzziness(q.Fuzziness)
+	case *query.DateRangeStringQuery:
+		if m == nil {
+			return nil
+		}
+		parserName := q.DateTimeParser
+		if parserName == "" {
+			parserName = query.QueryDateTimeParser
+		}
+		parser := m.DateTimeParserNamed(parserName)
+		if parser == nil {
+			return fmt.Errorf("no date time parser named '%s'", parserName)
+		}
+		for _, date := range []string{q.Start, q.End} {
+			if date == "" {
+				continue
+			}
+			if _, _, err := parser.ParseDateTime(date); err != nil {
+				return fmt.Errorf("date '%s' can't be parsed by %s: %w", date, parserName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// searchRequestFromURL builds a search request from URL parameters:
+//
+//	q       query string syntax query; everything if empty
+//	size    number of hits to return (default 10)
+//	from    number of hits to skip
+//	sort    comma separated fields to sort by, "-" prefixed for descending
+//	fields  comma separated stored fields to return, or "*"
+//	facet   field to facet on, or field:size; may be repeated
+//	filter  field:value that hits must match; may be repeated
+//	highlight  "true" to highlight matches
+func searchRequestFromURL(params url.Values) (*bleve.SearchRequest, error) {
+	var q query.Query = bleve.NewMatchAllQuery()
+	if qs := params.Get("q"); qs != "" {
+		q = bleve.NewQueryStringQuery(qs)
+	}
+
+	if filters := params["filter"]; len(filters) > 0 {
+		conjuncts := []query.Query{q}
+		for _, filter := range filters {
+			field, value, ok := strings.Cut(filter, ":")
+			if !ok || field == "" || value == "" {
+				return nil, fmt.Errorf("filter '%s' is not field:value", filter)
+			}
+			match := bleve.NewMatchQuery(value)
+			match.SetField(field)
+			match.SetOperator(query.MatchQueryOperatorAnd)
+			conjuncts = append(conjuncts, match)
+		}
+		q = bleve.NewConjunctionQuery(conjuncts...)
+	}
+
+	size, err := intParam(params, "size", 10)
+	if err != nil {
+		return nil, err
+	}
+	from, err := intParam(params, "from", 0)
+	if err != nil {
+		return nil, err
+	}
+	highlight := false
+	if h := params.Get("highlight"); h != "" {
+		highlight, err = strconv.ParseBool(h)
+		if err != nil {
+			return nil, fmt.Errorf("highlight '%s' is not true or false", h)
+		}
+	}
+	rv := bleve.NewSearchRequestOptions(q, size, from, false)
+	if highlight {
+		rv.Highlight = bleve.NewHighlight()
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		rv.SortBy(strings.Split(sort, ","))
+	}
+	if fields := params.Get("fields"); fields != "" {
+		rv.Fields = strings.Split(fields, ",")
+	}
+	for _, facet := range params["facet"] {
+		field, sizeStr, hasSize := strings.Cut(facet, ":")
+		facetSize := 10
+		if hasSize {
+			facetSize, err = strconv.Atoi(sizeStr)
+			if err != nil || facetSize < 1 {
+				return nil, fmt.Errorf("facet '%s' has an invalid size", facet)
+			}
+		}
+		rv.AddFacet(field, bleve.NewFacetRequest(field, facetSize))
+	}
+	return rv, nil
+}
+
+func intParam(params url.Values, name string, def int) (int, error) {
+	s := params.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s '%s' is not a non-negative integer", name, s)
+	}
+	return i, nil
+}
+
+// timeout returns how long the search in req may run: the maximum, or
+// the timeout request parameter if that is shorter.
+func (h *searchHandler) timeout(req *http.Request) (time.Duration, error) {
+	timeout := h.maxTimeout
+	if timeoutStr := req.FormValue("timeout"); timeoutStr != "" {
+		requested, err := time.ParseDuration(timeoutStr)
+		if err != nil || requested <= 0 {
+			return 0, fmt.Errorf("invalid timeout '%s'", timeoutStr)
+		}
+		if requested < timeout {
+			timeout = requested
+		}
+	}
+	return timeout, nil
+}
+
+// runSearch runs searchRequest on index within timeout, and reports
+// whether the timeout was hit. If only some shards of a sharded index
+// timed out, the partial result is returned without error.
+func runSearch(ctx context.Context, index bleve.Index, searchRequest *bleve.SearchRequest, timeout time.Duration) (*bleve.SearchResult, bool, error) {
+	ctx, span := startSpan(ctx, "search")
+	span.set("query_type", queryTypeName(searchRequest.Query))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	searchResponse, err := index.SearchInContext(ctx, searchRequest)
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if err == nil && searchResponse.Status.Failed > 0 {
+		if searchResponse.Status.Successful == 0 {
+			// all shards failed, which is no result at all
+			err = ctx.Err()
+			if err == nil {
+				err = fmt.Errorf("every shard failed: %v", searchResponse.Status.Errors)
+			}
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if searchResponse != nil {
+		span.set("hits", searchResponse.Total)
+	}
+	span.end(err)
+	return searchResponse, timedOut, err
+}
@@ -0,0 +1,211 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+// slowIndex is a shard whose searches never finish before the deadline.
+type slowIndex struct {
+	bleve.IndexAlias
+}
+
+func (s slowIndex) Name() string {
+	return "slow"
+}
+
+func (s slowIndex) SearchInContext(ctx context.Context, req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSearchHandlerTimeouts(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 100)
+
+	bleveHttp.RegisterIndexName("beer-search-test", index)
+	defer bleveHttp.UnregisterIndexByName("beer-search-test")
+	bleveHttp.RegisterIndexName("beer-slow-test", slowIndex{bleve.NewIndexAlias(index)})
+	defer bleveHttp.UnregisterIndexByName("beer-slow-test")
+	bleveHttp.RegisterIndexName("beer-partial-test", newShardedIndex([]bleve.Index{index, slowIndex{bleve.NewIndexAlias(index)}}))
+	defer bleveHttp.UnregisterIndexByName("beer-partial-test")
+
+	body := `{"query": {"query": "ale"}}`
+	tests := []struct {
+		index    string
+		url      string
+		status   int
+		timedOut bool
+	}{
+		{"beer-search-test", "/api/search", 200, false},
+		{"beer-search-test", "/api/search?timeout=1s", 200, false},
+		{"beer-search-test", "/api/search?timeout=soon", 400, false},
+		{"beer-slow-test", "/api/search?timeout=10ms", 504, false},
+		{"beer-partial-test", "/api/search?timeout=10ms", 200, true},
+	}
+	for _, test := range tests {
+		handler := newSearchHandler(test.index, time.Minute, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", test.url, strings.NewReader(body)))
+		if rec.Code != test.status {
+			t.Errorf("%s on %s: expected status %d, got %d: %s", test.url, test.index, test.status, rec.Code, rec.Body)
+			continue
+		}
+		if timedOut := rec.Header().Get("X-Search-Timed-Out") == "true"; timedOut != test.timedOut {
+			t.Errorf("%s on %s: expected timed out %v, got %v", test.url, test.index, test.timedOut, timedOut)
+		}
+		if rec.Code != 200 {
+			continue
+		}
+		var result struct {
+			Status struct {
+				Failed int `json:"failed"`
+			} `json:"status"`
+			Total uint64 `json:"total_hits"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Total == 0 {
+			t.Errorf("%s on %s: expected hits", test.url, test.index)
+		}
+		if test.timedOut && result.Status.Failed != 1 {
+			t.Errorf("%s on %s: expected one failed shard, got %d", test.url, test.index, result.Status.Failed)
+		}
+	}
+
+	// the server's maximum applies when it is shorter than requested
+	handler := newSearchHandler("beer-slow-test", 10*time.Millisecond, nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/search?timeout=1h", strings.NewReader(body)))
+	if rec.Code != 504 {
+		t.Errorf("expected maximum timeout to apply, got status %d", rec.Code)
+	}
+
+	// nothing is written for a client that went away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/search", strings.NewReader(body)).WithContext(ctx)
+	handler.ServeHTTP(rec, req)
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected no response to a cancelled request, got %q", rec.Body)
+	}
+}
+
+func TestSearchRequestFromURL(t *testing.T) {
+	tests := []struct {
+		query string
+		valid bool
+	}{
+		{"", true},
+		{"q=stout&size=5&from=10", true},
+		{"q=abv:>5&sort=-abv,_id&fields=name,abv", true},
+		{"facet=style&facet=abv:3&filter=style:Stout&highlight=true", true},
+		{"size=-1", false},
+		{"from=many", false},
+		{"filter=Stout", false},
+		{"facet=style:none", false},
+		{"highlight=maybe", false},
+	}
+	for _, test := range tests {
+		params, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr, err := searchRequestFromURL(params)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %v, got error %v", test.query, test.valid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if params.Get("size") == "" && sr.Size != 10 {
+			t.Errorf("%q: expected default size 10, got %d", test.query, sr.Size)
+		}
+		if len(sr.Facets) != len(params["facet"]) {
+			t.Errorf("%q: expected %d facets, got %d", test.query, len(params["facet"]), len(sr.Facets))
+		}
+	}
+}
+
+func TestSearchHandlerGet(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 300)
+
+	bleveHttp.RegisterIndexName("beer-get-test", index)
+	defer bleveHttp.UnregisterIndexByName("beer-get-test")
+	handler := newSearchHandler("beer-get-test", time.Minute, nil)
+
+	// a GET is answered exactly like the equivalent POST
+	get := httptest.NewRecorder()
+	handler.ServeHTTP(get, httptest.NewRequest("GET", "/api/search?q=ale&size=5&sort=-abv,_id&facet=style:3&filter=type:beer", nil))
+	post := httptest.NewRecorder()
+	handler.ServeHTTP(post, httptest.NewRequest("POST", "/api/search", strings.NewReader(`{
+		"query": {"conjuncts": [{"query": "ale"}, {"match": "beer", "field": "type", "operator": "and"}]},
+		"size": 5,
+		"sort": ["-abv", "_id"],
+		"facets": {"style": {"field": "style", "size": 3}}
+	}`)))
+	if get.Code != 200 || post.Code != 200 {
+		t.Fatalf("expected 200s, got %d: %s and %d: %s", get.Code, get.Body, post.Code, post.Body)
+	}
+	var getResult, postResult bleve.SearchResult
+	if err := json.Unmarshal(get.Body.Bytes(), &getResult); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(post.Body.Bytes(), &postResult); err != nil {
+		t.Fatal(err)
+	}
+	if getResult.Total == 0 || getResult.Total != postResult.Total || len(getResult.Hits) != len(postResult.Hits) {
+		t.Fatalf("expected the same results, got %d/%d hits and %d/%d", getResult.Total, len(getResult.Hits), postResult.Total, len(postResult.Hits))
+	}
+	for i := range getResult.Hits {
+		if getResult.Hits[i].ID != postResult.Hits[i].ID {
+			t.Errorf("hit %d: GET returned %s, POST %s", i, getResult.Hits[i].ID, postResult.Hits[i].ID)
+		}
+	}
+	if len(getResult.Facets["style"].Terms.Terms()) == 0 {
+		t.Errorf("expected style facet terms")
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/search?size=lots", nil))
+	if rec.Code != 400 {
+		t.Errorf("expected 400 for invalid size, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,388 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/document"
+	"github.com/blevesearch/bleve/v2/mapping"
+	index "github.com/blevesearch/bleve_index_api"
+)
+
+var shardCount = flag.Int("shards", 1, "number of shards for a new index")
+
+// shardedIndex spreads documents over several bleve indexes by a hash of
+// the document ID. Searches are scattered to every shard and gathered by
+// the embedded alias; single document operations go to the one shard
+// that owns the ID.
+type shardedIndex struct {
+	bleve.IndexAlias
+	shards []bleve.Index
+}
+
+func newShardedIndex(shards []bleve.Index) *shardedIndex {
+	return &shardedIndex{
+		IndexAlias: bleve.NewIndexAlias(shards...),
+		shards:     shards,
+	}
+}
+
+// shardFor returns which of n shards owns the document id.
+func shardFor(id string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (s *shardedIndex) shard(id string) bleve.Index {
+	return s.shards[shardFor(id, len(s.shards))]
+}
+
+func (s *shardedIndex) Index(id string, data interface{}) error {
+	return s.shard(id).Index(id, data)
+}
+
+func (s *shardedIndex) Delete(id string) error {
+	return s.shard(id).Delete(id)
+}
+
+func (s *shardedIndex) Document(id string) (index.Document, error) {
+	return s.shard(id).Document(id)
+}
+
+// NewBatch returns a batch for the index. The shards share the mapping,
+// so the first shard's batch maps documents the same as any other's.
+func (s *shardedIndex) NewBatch() *bleve.Batch {
+	return s.shards[0].NewBatch()
+}
+
+// Batch executes b on the shards, each document going to the shard that
+// owns its ID and internal keys to the first shard.
+func (s *shardedIndex) Batch(b *bleve.Batch) error {
+	ops, err := batchOps(b)
+	if err != nil {
+		return err
+	}
+	batches := make([]*bleve.Batch, len(s.shards))
+	for n, shard := range s.shards {
+		batches[n] = shard.NewBatch()
+	}
+	for id, doc := range ops.IndexOps {
+		batch := batches[shardFor(id, len(s.shards))]
+		if doc == nil {
+			batch.Delete(id)
+			continue
+		}
+		mapped, ok := doc.(*document.Document)
+		if !ok {
+			return fmt.Errorf("document %s is a %T, not a *document.Document", id, doc)
+		}
+		if err := batch.IndexAdvanced(mapped); err != nil {
+			return err
+		}
+	}
+	for key, val := range ops.InternalOps {
+		if val == nil {
+			batches[0].DeleteInternal([]byte(key))
+		} else {
+			batches[0].SetInternal([]byte(key), val)
+		}
+	}
+	return flushBatches(s.shards, batches)
+}
+
+// batchOps returns the operations queued in b, which bleve doesn't
+// export.
+func batchOps(b *bleve.Batch) (*index.Batch, error) {
+	field := reflect.ValueOf(b).Elem().FieldByName("internal")
+	if !field.IsValid() || field.Type() != reflect.TypeOf((*index.Batch)(nil)) {
+		return nil, fmt.Errorf("sharded index can't read the operations of this version of bleve's batches")
+	}
+	return (*index.Batch)(unsafe.Pointer(field.Pointer())), nil
+}
+
+// SetInternal stores key on the first shard.
+func (s *shardedIndex) SetInternal(key, val []byte) error {
+	return s.shards[0].SetInternal(key, val)
+}
+
+func (s *shardedIndex) GetInternal(key []byte) ([]byte, error) {
+	return s.shards[0].GetInternal(key)
+}
+
+func (s *shardedIndex) DeleteInternal(key []byte) error {
+	return s.shards[0].DeleteInternal(key)
+}
+
+// Advanced fails, as there is no one underlying index.
+func (s *shardedIndex) Advanced() (index.Index, error) {
+	return nil, fmt.Errorf("sharded index has no single underlying index")
+}
+
+// Fields returns every field found in any shard.
+func (s *shardedIndex) Fields() ([]string, error) {
+	var rv []string
+	seen := map[string]bool{}
+	for _, shard := range s.shards {
+		fields, err := shard.Fields()
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			if !seen[field] {
+				seen[field] = true
+				rv = append(rv, field)
+			}
+		}
+	}
+	return rv, nil
+}
+
+// FieldDict returns the term dictionary of field over every shard.
+func (s *shardedIndex) FieldDict(field string) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(shard bleve.Index) (index.FieldDict, error) {
+		return shard.FieldDict(field)
+	})
+}
+
+func (s *shardedIndex) FieldDictRange(field string, startTerm []byte, endTerm []byte) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(shard bleve.Index) (index.FieldDict, error) {
+		return shard.FieldDictRange(field, startTerm, endTerm)
+	})
+}
+
+func (s *shardedIndex) FieldDictPrefix(field string, termPrefix []byte) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(shard bleve.Index) (index.FieldDict, error) {
+		return shard.FieldDictPrefix(field, termPrefix)
+	})
+}
+
+func (s *shardedIndex) mergeFieldDicts(open func(bleve.Index) (index.FieldDict, error)) (index.FieldDict, error) {
+	rv := &mergedFieldDict{}
+	for _, shard := range s.shards {
+		dict, err := open(shard)
+		if err != nil {
+			rv.Close()
+			return nil, err
+		}
+		rv.dicts = append(rv.dicts, dict)
+		rv.heads = append(rv.heads, nil)
+		if err := rv.advance(len(rv.dicts) - 1); err != nil {
+			rv.Close()
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// mergedFieldDict merges the sorted term dictionaries of the shards,
+// adding up the counts of terms found in more than one.
+type mergedFieldDict struct {
+	dicts []index.FieldDict
+	// heads holds the next entry of each dictionary, or nil at its end
+	heads []*index.DictEntry
+}
+
+// advance moves dictionary n on to its next entry. Dictionaries reuse
+// the entry they return, so it is copied.
+func (m *mergedFieldDict) advance(n int) error {
+	entry, err := m.dicts[n].Next()
+	if err != nil || entry == nil {
+		m.heads[n] = nil
+		return err
+	}
+	m.heads[n] = &index.DictEntry{Term: entry.Term, Count: entry.Count}
+	return nil
+}
+
+func (m *mergedFieldDict) Next() (*index.DictEntry, error) {
+	var rv *index.DictEntry
+	for _, head := range m.heads {
+		if head != nil && (rv == nil || head.Term < rv.Term) {
+			rv = &index.DictEntry{Term: head.Term}
+		}
+	}
+	if rv == nil {
+		return nil, nil
+	}
+	for n, head := range m.heads {
+		if head != nil && head.Term == rv.Term {
+			rv.Count += head.Count
+			if err := m.advance(n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rv, nil
+}
+
+func (m *mergedFieldDict) Close() error {
+	var rv error
+	for _, dict := range m.dicts {
+		if err := dict.Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
+
+func (m *mergedFieldDict) BytesRead() uint64 {
+	var rv uint64
+	for _, dict := range m.dicts {
+		rv += dict.BytesRead()
+	}
+	return rv
+}
+
+// Mapping returns the mapping, which all shards share.
+func (s *shardedIndex) Mapping() mapping.IndexMapping {
+	return s.shards[0].Mapping()
+}
+
+// CopyTo copies each shard into its own subdirectory of d, giving the
+// same layout as newIndex.
+func (s *shardedIndex) CopyTo(d index.Directory) error {
+	dir, ok := d.(bleve.FileSystemDirectory)
+	if !ok {
+		return fmt.Errorf("sharded index can only be copied to the file system")
+	}
+	for n, shard := range s.shards {
+		copyable, ok := shard.(bleve.IndexCopyable)
+		if !ok {
+			return fmt.Errorf("shard %d does not support online copy", n)
+		}
+		err := copyable.CopyTo(bleve.FileSystemDirectory(shardPath(string(dir), n)))
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// Close closes every shard.
+func (s *shardedIndex) Close() error {
+	var rv error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	s.IndexAlias.Close()
+	return rv
+}
+
+// indexShards returns the indexes that documents for i must be written
+// to: its shards, or i itself.
+func indexShards(i bleve.Index) []bleve.Index {
+	if s, ok := i.(*shardedIndex); ok {
+		return s.shards
+	}
+	return []bleve.Index{i}
+}
+
+// flushBatches executes each non-empty batch on the matching shard, in
+// parallel, and resets them for reuse.
+func flushBatches(shards []bleve.Index, batches []*bleve.Batch) error {
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for n := range shards {
+		if batches[n].Size() == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs[n] = shards[n].Batch(batches[n])
+			batches[n].Reset()
+		}(n)
+	}
+	wg.Wait()
+	indexChanged()
+
+	for n, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", n, err)
+		}
+	}
+	return nil
+}
+
+func shardPath(path string, n int) string {
+	return filepath.Join(path, fmt.Sprintf("shard-%d.bleve", n))
+}
+
+// newIndex creates an index at path with the given number of shards. A
+// single shard is a plain bleve index; otherwise path is a directory
+// holding one bleve index per shard.
+func newIndex(path string, m mapping.IndexMapping, shards int) (bleve.Index, error) {
+	if shards <= 1 {
+		return bleve.New(path, m)
+	}
+
+	err := os.Mkdir(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []bleve.Index
+	for n := 0; n < shards; n++ {
+		shard, err := bleve.New(shardPath(path, n), m)
+		if err != nil {
+			for _, shard := range indexes {
+				shard.Close()
+			}
+			return nil, err
+		}
+		indexes = append(indexes, shard)
+	}
+	return newShardedIndex(indexes), nil
+}
+
+// openIndex opens the index at path made by newIndex, however many
+// shards it has.
+func openIndex(path string) (bleve.Index, error) {
+	return openIndexUsing(path, nil)
+}
+
+// openIndexUsing is openIndex with runtime config for the index and each
+// of its shards, as for bleve.OpenUsing.
+func openIndexUsing(path string, runtimeConfig map[string]interface{}) (bleve.Index, error) {
+	idx, err := bleve.OpenUsing(path, runtimeConfig)
+	if err != bleve.ErrorIndexMetaMissing {
+		return idx, err
+	}
+
+	var indexes []bleve.Index
+	for n := 0; ; n++ {
+		shard, err := bleve.OpenUsing(shardPath(path, n), runtimeConfig)
+		if err == bleve.ErrorIndexPathDoesNotExist {
+			if n > 0 {
+				break
+			}
+			// not an index, sharded or otherwise
+			return nil, bleve.ErrorIndexMetaMissing
+		} else if err != nil {
+			for _, shard := range indexes {
+				shard.Close()
+			}
+			return nil, err
+		}
+		indexes = append(indexes, shard)
+	}
+	return newShardedIndex(indexes), nil
+}
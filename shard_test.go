@@ -0,0 +1,239 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+func TestShardedSearchMatchesSingleIndex(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+
+	single, err := newIndex(filepath.Join(tempDir, "single.bleve"), mapping, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+
+	index, err := newIndex(filepath.Join(tempDir, "sharded.bleve"), mapping, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharded := index.(*shardedIndex)
+	shards := sharded.shards
+	defer sharded.Close()
+
+	for _, index := range []bleve.Index{single, sharded} {
+		if _, err := indexBeer(context.Background(), index, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every shard got some of the documents, and none twice
+	total := uint64(0)
+	for n, shard := range shards {
+		count, err := shard.DocCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			t.Errorf("shard %d is empty", n)
+		}
+		total += count
+	}
+	if total != 7303 {
+		t.Errorf("expected 7303 documents across shards, got %d", total)
+	}
+
+	// the queries from TestBeerSearchAll
+	termQuery := bleve.NewTermQuery("shock")
+	termQuery.SetField("name")
+	queryMin := 50.0
+	numericRangeQuery := bleve.NewNumericRangeQuery(&queryMin, nil)
+	numericRangeQuery.SetField("abv")
+	queryStartDate, err := time.Parse("2006-01-02", "2011-10-04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dateRangeQuery := bleve.NewDateRangeQuery(queryStartDate, time.Time{})
+	dateRangeQuery.SetField("updated")
+	prefixQuery := bleve.NewPrefixQuery("adir")
+	prefixQuery.SetField("name")
+
+	queries := []query.Query{
+		termQuery,
+		bleve.NewMatchPhraseQuery("spicy mexican food"),
+		bleve.NewQueryStringQuery("+name:light +description:water -description:barley"),
+		numericRangeQuery,
+		dateRangeQuery,
+		prefixQuery,
+		bleve.NewMatchQuery("stout"),
+	}
+
+	for _, q := range queries {
+		var results [][]string
+		for _, index := range []bleve.Index{single, sharded} {
+			req := bleve.NewSearchRequestOptions(q, 10000, 0, false)
+			res, err := index.Search(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, hit := range res.Hits {
+				ids = append(ids, hit.ID)
+			}
+			sort.Strings(ids)
+			results = append(results, ids)
+		}
+		if !reflect.DeepEqual(results[0], results[1]) {
+			t.Errorf("query %#v: single index found %v, sharded found %v", q, results[0], results[1])
+		}
+	}
+
+	// single document operations go to the owning shard
+	doc, err := sharded.Document("anheuser_busch-shock_top")
+	if err != nil || doc == nil {
+		t.Errorf("expected to find document in its shard, got %v, %v", doc, err)
+	}
+	fields, err := sharded.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) == 0 {
+		t.Errorf("expected fields from the shards")
+	}
+}
+
+func TestNewAndOpenShardedIndex(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "beer-search.bleve")
+	useTestData(t, 300)
+
+	index, err := newIndex(path, mapping, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexBeer(context.Background(), index, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := checkIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 300 {
+		t.Errorf("expected 300 documents, got %d", count)
+	}
+
+	index, err = openIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if n := len(indexShards(index)); n != 3 {
+		t.Errorf("expected 3 shards, got %d", n)
+	}
+
+	// backups keep the shards
+	backupPath := path + ".tar.gz"
+	if err := backupIndex(index, backupPath); err != nil {
+		t.Fatal(err)
+	}
+	restorePath := path + ".restored"
+	if _, err := restoreIndex(backupPath, restorePath); err != nil {
+		t.Fatal(err)
+	}
+	count, err = checkIndex(restorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 300 {
+		t.Errorf("expected 300 documents restored, got %d", count)
+	}
+}
+
+func TestShardedBatch(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := newIndex(filepath.Join(t.TempDir(), "beer-search.bleve"), mapping, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 20)
+
+	// each document is on the shard that owns it, and only there
+	shards := indexShards(index)
+	for n, shard := range shards {
+		count, err := shard.DocCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 || count == 20 {
+			t.Errorf("expected shard %d to have some of the documents, got %d", n, count)
+		}
+	}
+	id := "21st_amendment_brewery_cafe-21a_ipa"
+	for n, shard := range shards {
+		doc, err := shard.Document(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owns := n == shardFor(id, len(shards)); owns != (doc != nil) {
+			t.Errorf("expected %s on shard %d to be %t, got %v", id, n, owns, doc)
+		}
+	}
+
+	batch := index.NewBatch()
+	batch.Delete(id)
+	batch.SetInternal([]byte("key"), []byte("value"))
+	if err := index.Batch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := index.DocCount(); err != nil || count != 19 {
+		t.Errorf("expected 19 documents after the delete, got %d %v", count, err)
+	}
+	if doc, err := index.Document(id); err != nil || doc != nil {
+		t.Errorf("expected %s to be deleted, got %v %v", id, doc, err)
+	}
+	if val, err := shards[0].GetInternal([]byte("key")); err != nil || string(val) != "value" {
+		t.Errorf("expected the internal key on the first shard, got %q %v", val, err)
+	}
+	if val, err := index.GetInternal([]byte("key")); err != nil || string(val) != "value" {
+		t.Errorf("expected the internal key, got %q %v", val, err)
+	}
+	if err := index.DeleteInternal([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := index.GetInternal([]byte("key")); err != nil || val != nil {
+		t.Errorf("expected the internal key to be deleted, got %q %v", val, err)
+	}
+}
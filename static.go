@@ -0,0 +1,190 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// embeddedStatic is the UI, built into the binary so that it runs without
+// the static directory next to it. -static serves a directory instead,
+// for working on the UI without rebuilding.
+//
+//go:generate go run static_gen.go static
+//go:embed static
+var embeddedStatic embed.FS
+
+// staticAsset is a file of the UI, read into memory with its compressed
+// variants.
+type staticAsset struct {
+	content     []byte
+	gzip        []byte
+	brotli      []byte
+	contentType string
+	// version is a hash of the content, used as its ETag and to version
+	// links to it
+	version string
+}
+
+// staticAssets serves the files of the UI. Each has an ETag of its
+// content hash, and is served compressed when the client accepts it.
+// Gzip variants are made when the files are loaded, and a file with a .gz
+// or .br next to it in the tree is served as those instead. Brotli is
+// too slow to compress with when loading, so go generate makes the .br
+// variants.
+//
+// index.html links to the other files with their version in the query,
+// as ?v=, and a request with the file's current version may be cached for
+// good. Other requests must be revalidated.
+type staticAssets struct {
+	files map[string]*staticAsset
+}
+
+// loadStaticAssets reads every file in fsys.
+func loadStaticAssets(fsys fs.FS) (*staticAssets, error) {
+	rv := &staticAssets{
+		files: map[string]*staticAsset{},
+	}
+	variants := map[string][]byte{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if ext := path.Ext(name); ext == ".gz" || ext == ".br" {
+			variants[name] = content
+			return nil
+		}
+		rv.files[name] = newStaticAsset(name, content)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name, content := range variants {
+		asset, ok := rv.files[strings.TrimSuffix(name, path.Ext(name))]
+		switch {
+		case !ok:
+			// not a variant, just a compressed file
+			rv.files[name] = newStaticAsset(name, content)
+		case path.Ext(name) == ".gz":
+			asset.gzip = content
+		default:
+			asset.brotli = content
+		}
+	}
+
+	if index, ok := rv.files["index.html"]; ok {
+		rv.files["index.html"] = newStaticAsset("index.html", rv.versionLinks(index.content))
+	}
+	for _, asset := range rv.files {
+		if asset.gzip == nil {
+			asset.gzip = gzipIfSmaller(asset.content)
+		}
+	}
+	return rv, nil
+}
+
+func newStaticAsset(name string, content []byte) *staticAsset {
+	sum := sha256.Sum256(content)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	return &staticAsset{
+		content:     content,
+		contentType: contentType,
+		version:     hex.EncodeToString(sum[:8]),
+	}
+}
+
+// gzipIfSmaller compresses content, or returns nil if that doesn't save
+// at least a tenth of it, as for images and fonts.
+func gzipIfSmaller(content []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	w.Write(content)
+	w.Close()
+	if buf.Len() > len(content)*9/10 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+var staticLinkRegexp = regexp.MustCompile(`(?:src|href)="/static/([^"?#]+)"`)
+
+// versionLinks adds the version of each file linked from html.
+func (s *staticAssets) versionLinks(html []byte) []byte {
+	return staticLinkRegexp.ReplaceAllFunc(html, func(link []byte) []byte {
+		name := string(staticLinkRegexp.FindSubmatch(link)[1])
+		asset, ok := s.files[name]
+		if !ok {
+			return link
+		}
+		return []byte(strings.TrimSuffix(string(link), `"`) + "?v=" + asset.version + `"`)
+	})
+}
+
+func (s *staticAssets) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	asset, ok := s.files[name]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	if v := req.URL.Query().Get("v"); v != "" && v == asset.version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", asset.contentType)
+
+	content := asset.content
+	etag := asset.version
+	if asset.gzip != nil || asset.brotli != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		acceptEncoding := req.Header.Get("Accept-Encoding")
+		switch {
+		case asset.brotli != nil && acceptsEncoding(acceptEncoding, "br"):
+			content = asset.brotli
+			etag += "-br"
+			w.Header().Set("Content-Encoding", "br")
+		case asset.gzip != nil && acceptsEncoding(acceptEncoding, "gzip"):
+			content = asset.gzip
+			etag += "-gzip"
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+
+	http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(content))
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the
+// named content coding.
+func acceptsEncoding(header, coding string) bool {
+	return headerQ(header, coding) > 0
+}
@@ -0,0 +1,35 @@
+function AnalyzeCtrl($scope, $http, $routeParams, $log, $sce) {
+
+	$scope.text = "";
+	$scope.by = "field";
+	$scope.field = "description";
+	$scope.analyzer = "en";
+
+    $http.get('/api/fields').success(function(data) {
+        $scope.fieldNames = data.fields;
+    }).
+    error(function(data, code) {
+
+    });
+
+    $scope.analyze = function() {
+        var requestBody = {
+            "text": $scope.text
+        };
+        if ($scope.by === "field") {
+            requestBody.field = $scope.field;
+        } else {
+            requestBody.analyzer = $scope.analyzer;
+        }
+        $http.post('/api/analyze', requestBody).
+        success(function(data) {
+            $scope.errorMessage = null;
+            $scope.results = data;
+        }).
+        error(function(data, code) {
+            delete $scope.results;
+            $scope.errorMessage = data.message || data;
+        });
+    };
+
+}
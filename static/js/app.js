@@ -21,6 +21,7 @@ config(['$routeProvider', '$locationProvider', function($routeProvider, $locatio
   $routeProvider.when('/search/date_range/', {templateUrl: '/static/partials/search/date_range.html', controller: 'SearchCtrl'});
   $routeProvider.when('/search/prefix/', {templateUrl: '/static/partials/search/prefix.html', controller: 'SearchCtrl'});
   $routeProvider.when('/search/debug/', {templateUrl: '/static/partials/debug.html', controller: 'DebugCtrl'});
+  $routeProvider.when('/search/analyze/', {templateUrl: '/static/partials/analyze.html', controller: 'AnalyzeCtrl'});
   $routeProvider.otherwise({redirectTo: '/overview'});
   $locationProvider.html5Mode(true);
 }]);
@@ -159,6 +159,28 @@ function SearchCtrl($scope, $http, $routeParams, $log, $sce) {
         });
     };
 
+    $scope.validateSyntax = function() {
+        if (!$scope.syntax) {
+            delete $scope.syntaxError;
+            return;
+        }
+        var syntax = $scope.syntax;
+        $http.post('/api/validate', {"query": syntax}).
+        success(function(data) {
+            if (syntax !== $scope.syntax) {
+                // a later edit has already been sent
+                return;
+            }
+            $scope.syntaxError = data.error;
+            if ($scope.syntaxError && $scope.syntaxError.position !== undefined) {
+                $scope.syntaxError.caret = new Array($scope.syntaxError.position + 1).join(" ") + "^";
+            }
+        }).
+        error(function(data, code) {
+
+        });
+    };
+
     $scope.searchSyntax = function() {
         $http.post('/api/search', {
             "size": 10,
@@ -279,7 +301,7 @@ function SearchCtrl($scope, $http, $routeParams, $log, $sce) {
             $scope.processResults(data);
         }).
         error(function(data, code) {
-                $scope.errorMessage = data;
+                $scope.errorMessage = data.message || data;
                 return;
         });
     };
@@ -385,7 +407,7 @@ function SearchCtrl($scope, $http, $routeParams, $log, $sce) {
             $scope.processResults(data);
         }).
         error(function(data, code) {
-                $scope.errorMessage = data;
+                $scope.errorMessage = data.message || data;
                 return;
         });
     };
@@ -0,0 +1,93 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build ignore
+// +build ignore
+
+// This program writes a brotli variant, name.br, next to each file of the
+// UI that it makes at least a tenth smaller, and removes variants of files
+// that are gone or don't compress. The server embeds the variants and
+// serves them to clients that accept brotli. Run it with go generate
+// after changing the UI.
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/andybalholm/brotli"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatal("usage: go run static_gen.go <static dir>")
+	}
+	dir := os.Args[1]
+
+	var sources, variants []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".br":
+			variants = append(variants, path)
+		case ".gz":
+		default:
+			// index.html is rewritten as it is loaded, so it can't
+			// have a variant
+			if path != filepath.Join(dir, "index.html") {
+				sources = append(sources, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wanted := map[string]bool{}
+	for _, path := range sources {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			log.Fatal(err)
+		}
+		if buf.Len() > len(content)*9/10 {
+			continue
+		}
+
+		variant := path + ".br"
+		wanted[variant] = true
+		if old, err := os.ReadFile(variant); err == nil && bytes.Equal(old, buf.Bytes()) {
+			continue
+		}
+		log.Printf("Writing %s", variant)
+		if err := os.WriteFile(variant, buf.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, variant := range variants {
+		if !wanted[variant] {
+			log.Printf("Removing %s", variant)
+			if err := os.Remove(variant); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
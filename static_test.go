@@ -0,0 +1,138 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestStaticAssets(t *testing.T) {
+	appJS := strings.Repeat("console.log('beer');\n", 100)
+	assets, err := loadStaticAssets(fstest.MapFS{
+		"index.html":    {Data: []byte(`<script src="/static/js/app.js"></script><img src="/static/img/missing.png">`)},
+		"js/app.js":     {Data: []byte(appJS)},
+		"js/app.js.br":  {Data: []byte("brotli")},
+		"img/small.png": {Data: []byte("\x89PNG")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := assets.files["js/app.js"].version
+
+	get := func(url string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for n := 0; n < len(headers); n += 2 {
+			req.Header.Set(headers[n], headers[n+1])
+		}
+		rec := httptest.NewRecorder()
+		assets.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// links from index.html carry the version of what they link to
+	rec := get("/index.html")
+	if rec.Code != 200 || rec.Body.String() != `<script src="/static/js/app.js?v=`+version+`"></script><img src="/static/img/missing.png">` {
+		t.Errorf("expected a versioned link to app.js, got %d: %s", rec.Code, rec.Body)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("expected index.html to be revalidated, got %s", cc)
+	}
+
+	rec = get("/js/app.js?v=" + version)
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("expected a versioned request to be cached for good, got %s", cc)
+	}
+	if rec.Body.String() != appJS || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected app.js uncompressed")
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.Contains(ct, "javascript") {
+		t.Errorf("expected a javascript content type, got %s", ct)
+	}
+	if cc := get("/js/app.js?v=old").Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("expected an old version to be revalidated, got %s", cc)
+	}
+
+	etag := rec.Header().Get("ETag")
+	if etag != `"`+version+`"` {
+		t.Errorf("expected ETag of the version, got %s", etag)
+	}
+	if rec := get("/js/app.js", "If-None-Match", etag); rec.Code != 304 {
+		t.Errorf("expected 304 for a matching ETag, got %d", rec.Code)
+	}
+
+	rec = get("/js/app.js", "Accept-Encoding", "gzip, deflate")
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected gzip, got %v", rec.Header())
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != appJS {
+		t.Errorf("expected app.js gzipped, got %v", err)
+	}
+
+	rec = get("/js/app.js", "Accept-Encoding", "gzip, br")
+	if rec.Header().Get("Content-Encoding") != "br" || rec.Body.String() != "brotli" {
+		t.Errorf("expected the brotli variant, got %v", rec.Header())
+	}
+	rec = get("/js/app.js", "Accept-Encoding", "br;q=0, gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected gzip when brotli is refused, got %v", rec.Header())
+	}
+
+	// not worth compressing
+	if rec := get("/img/small.png", "Accept-Encoding", "gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected small.png uncompressed, got %v", rec.Header())
+	}
+	if rec := get("/js/app.js.br"); rec.Code != 404 {
+		t.Errorf("expected variants not to be served directly, got %d", rec.Code)
+	}
+	if rec := get("/js/"); rec.Code != 404 {
+		t.Errorf("expected no directory listing, got %d", rec.Code)
+	}
+
+	// the embedded UI
+	staticFS, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := loadStaticAssets(staticFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := embedded.files["index.html"]
+	if index == nil || !strings.Contains(string(index.content), "/static/js/app.js?v="+embedded.files["js/app.js"].version) {
+		t.Errorf("expected the embedded index.html to link to a version of app.js")
+	}
+
+	// with brotli variants made by go generate, which are up to date
+	if embedded.files["js/app.js"].brotli == nil {
+		t.Error("expected a brotli variant of app.js; run go generate")
+	}
+	for name, asset := range embedded.files {
+		if asset.brotli == nil {
+			continue
+		}
+		b, err := io.ReadAll(brotli.NewReader(bytes.NewReader(asset.brotli)))
+		if err != nil || !bytes.Equal(b, asset.content) {
+			t.Errorf("the brotli variant of %s is out of date; run go generate", name)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tlsCert     = flag.String("tlsCert", "", "TLS certificate file (PEM); with -tlsKey, serve HTTPS")
+	tlsKey      = flag.String("tlsKey", "", "TLS private key file (PEM)")
+	tlsClientCA = flag.String("tlsClientCA", "", "CA certificates file (PEM); if set, admin endpoints require a client certificate it signed")
+	enableHTTP2 = flag.Bool("http2", true, "serve HTTP/2 to TLS clients that support it")
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most.
+var certCheckInterval = 10 * time.Second
+
+// listenAddr is where the server listens: a TCP host and port, IPv6
+// hosts in brackets, or a unix socket given as unix:path.
+type listenAddr struct {
+	network string
+	address string
+}
+
+func parseListenAddr(addr string) (*listenAddr, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("addr '%s' has no socket path", addr)
+		}
+		return &listenAddr{network: "unix", address: path}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("addr '%s' is not host:port or unix:path: %v", addr, err)
+	}
+	if port == "" {
+		return nil, fmt.Errorf("addr '%s' has no port", addr)
+	}
+	if strings.Contains(host, ":") && net.ParseIP(strings.SplitN(host, "%", 2)[0]) == nil {
+		return nil, fmt.Errorf("addr '%s' has an invalid IPv6 address", addr)
+	}
+	return &listenAddr{network: "tcp", address: addr}, nil
+}
+
+// url returns the URL of the server for the log.
+func (l *listenAddr) url(scheme string) string {
+	if l.network == "unix" {
+		return scheme + "+unix://" + l.address
+	}
+	host, port, _ := net.SplitHostPort(l.address)
+	if host == "" || host == "::" || host == "0.0.0.0" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// listen listens on the address. A socket file left behind by a server
+// that didn't shut down cleanly is replaced.
+func (l *listenAddr) listen() (net.Listener, error) {
+	if l.network == "unix" {
+		if fi, err := os.Stat(l.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", l.address); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use", l.address)
+			}
+			os.Remove(l.address)
+		}
+	}
+	return net.Listen(l.network, l.address)
+}
+
+// certReloader serves a certificate and key from files, reloading them
+// when they change, so that renewed certificates are used without a
+// restart. If a reload fails, the last good certificate is kept.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	rv := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	modTimes, err := rv.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := rv.load(modTimes); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (c *certReloader) stat() ([2]time.Time, error) {
+	var rv [2]time.Time
+	for n, path := range []string{c.certPath, c.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return rv, err
+		}
+		rv[n] = fi.ModTime()
+	}
+	return rv, nil
+}
+
+func (c *certReloader) load(modTimes [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTimes = modTimes
+	return nil
+}
+
+// GetCertificate is for tls.Config, checking the files for changes once
+// every certCheckInterval.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now := time.Now(); now.Sub(c.lastCheck) >= certCheckInterval {
+		c.lastCheck = now
+		modTimes, err := c.stat()
+		if err != nil {
+			log.Printf("error checking TLS certificate: %v", err)
+		} else if modTimes != c.modTimes {
+			if err := c.load(modTimes); err != nil {
+				log.Printf("error reloading TLS certificate, keeping the old one: %v", err)
+			} else {
+				log.Printf("Reloaded TLS certificate %s", c.certPath)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// newTLSConfig returns the server's TLS config, or nil if it doesn't
+// serve TLS. With a client CA, clients may present certificates, which
+// clientCerts checks where they are required.
+func newTLSConfig(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	if certPath == "" {
+		return nil, nil
+	}
+	certs, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	rv := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if clientCAPath != "" {
+		pem, err := os.ReadFile(clientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAPath)
+		}
+		rv.ClientCAs = pool
+		rv.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return rv, nil
+}
+
+// validateTLSConfig checks the TLS settings go together.
+func validateTLSConfig() error {
+	switch {
+	case (*tlsCert == "") != (*tlsKey == ""):
+		return errors.New("tlsCert and tlsKey must be given together")
+	case *tlsClientCA != "" && *tlsCert == "":
+		return errors.New("tlsClientCA needs tlsCert and tlsKey")
+	}
+	return nil
+}
+
+// clientCerts requires requests to have been made with a verified client
+// certificate. A nil *clientCerts requires nothing, which is how the
+// server runs without -tlsClientCA.
+type clientCerts struct{}
+
+func newClientCerts(clientCAPath string) *clientCerts {
+	if clientCAPath == "" {
+		return nil
+	}
+	return &clientCerts{}
+}
+
+func (c *clientCerts) require(h http.Handler) http.Handler {
+	if c == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			showError(w, req, "a client certificate is required", 403)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,199 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		url     string
+	}{
+		{":8094", "tcp", "http://localhost:8094"},
+		{"127.0.0.1:8094", "tcp", "http://127.0.0.1:8094"},
+		{"[::1]:8094", "tcp", "http://[::1]:8094"},
+		{"[::]:8094", "tcp", "http://localhost:8094"},
+		{"[fe80::1%eth0]:8094", "tcp", "http://[fe80::1%eth0]:8094"},
+		{"unix:/run/beer-search.sock", "unix", "http+unix:///run/beer-search.sock"},
+		{"::1:8094", "", ""},
+		{"[nonsense:]:8094", "", ""},
+		{"localhost", "", ""},
+		{"localhost:", "", ""},
+		{"unix:", "", ""},
+	}
+	for _, test := range tests {
+		addr, err := parseListenAddr(test.addr)
+		if test.network == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		if addr.network != test.network || addr.url("http") != test.url {
+			t.Errorf("%s: expected %s %s, got %s %s", test.addr, test.network, test.url, addr.network, addr.url("http"))
+		}
+	}
+}
+
+// writeTestCert writes a certificate for localhost, signed by parent or
+// self-signed, and its key, and returns the certificate.
+func writeTestCert(t *testing.T, certPath, keyPath, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestCertReloader(t *testing.T) {
+	defer func(interval time.Duration) { certCheckInterval = interval }(certCheckInterval)
+	certCheckInterval = 0
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "first", nil, nil)
+	reloader, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Subject.CommonName
+	}
+	if name := commonName(); name != "first" {
+		t.Errorf("expected the first certificate, got %s", name)
+	}
+
+	// a renewed certificate is picked up
+	writeTestCert(t, certPath, keyPath, "second", nil, nil)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	if name := commonName(); name != "second" {
+		t.Errorf("expected the second certificate, got %s", name)
+	}
+
+	// and a broken one is not
+	os.WriteFile(keyPath, []byte("not a key"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyPath, later, later)
+	if name := commonName(); name != "second" {
+		t.Errorf("expected to keep the second certificate, got %s", name)
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	ca, caKey := writeTestCert(t, caPath, filepath.Join(dir, "ca.key"), "ca", nil, nil)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certPath, keyPath, "server", ca, caKey)
+	clientPath, clientKeyPath := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writeTestCert(t, clientPath, clientKeyPath, "admin", ca, caKey)
+
+	tlsConfig, err := newTLSConfig(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/admin/", newClientCerts(caPath).require(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})))
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, req *http.Request) {})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(path string, certs []tls.Certificate) int {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs, ServerName: "localhost"},
+		}}
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	clientCert, err := tls.LoadX509KeyPair(clientPath, clientKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := get("/api/search", nil); code != 200 {
+		t.Errorf("expected other routes to be open, got %d", code)
+	}
+	if code := get("/api/admin/backup", nil); code != 403 {
+		t.Errorf("expected admin routes to need a client certificate, got %d", code)
+	}
+	if code := get("/api/admin/backup", []tls.Certificate{clientCert}); code != 200 {
+		t.Errorf("expected the client certificate to be accepted, got %d", code)
+	}
+}
@@ -0,0 +1,357 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/gorilla/mux"
+)
+
+var (
+	accessLogPath = flag.String("accessLog", "", "file to append JSON access logs to, - for stdout; none if empty")
+	tracePath     = flag.String("trace", "", "file to append JSON trace spans to, - for stdout, or empty for none")
+)
+
+// openLogFile opens a file to append to, where "-" is stdout.
+func openLogFile(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// newID returns n random bytes in hex, for request, trace and span IDs.
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestInfo is what handlers note about a request for its access log
+// entry.
+type requestInfo struct {
+	id    string
+	route string
+
+	mutex     sync.Mutex
+	queryType string
+	hits      *uint64
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the requestInfo of a request's context, or nil
+// if it has none. Its methods do nothing on nil.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// noteQuery records the type of the query a request searched with.
+func (i *requestInfo) noteQuery(q query.Query) {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	i.queryType = queryTypeName(q)
+	i.mutex.Unlock()
+}
+
+// noteHits records how many hits a request's search found.
+func (i *requestInfo) noteHits(hits uint64) {
+	if i == nil {
+		return
+	}
+	i.mutex.Lock()
+	i.hits = &hits
+	i.mutex.Unlock()
+}
+
+// queryTypeName names the type of q as bleve's query JSON does, so that
+// *query.QueryStringQuery is query_string.
+func queryTypeName(q query.Query) string {
+	if q == nil {
+		return ""
+	}
+	t := reflect.TypeOf(q)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := strings.TrimSuffix(t.Name(), "Query")
+	var b strings.Builder
+	for n, r := range name {
+		if unicode.IsUpper(r) {
+			if n > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// noteRoute is router middleware recording the matched route.
+func noteRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if info := requestInfoFrom(req.Context()); info != nil {
+			if route := mux.CurrentRoute(req); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					info.route = template
+				}
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// requestID returns the X-Request-ID of a request, if it has a usable
+// one, or a new one.
+func requestID(req *http.Request) string {
+	id := req.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 {
+		return newID(16)
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return newID(16)
+		}
+	}
+	return id
+}
+
+// accessLog gives each request an ID, returned in the X-Request-ID
+// header, logs it as JSON once it is done, and traces it if spans is not
+// nil.
+type accessLog struct {
+	logger *slog.Logger
+	spans  *spanExporter
+}
+
+func newAccessLog(w io.Writer, spans *spanExporter) *accessLog {
+	rv := &accessLog{
+		spans: spans,
+	}
+	if w != nil {
+		rv.logger = slog.New(slog.NewJSONHandler(w, nil))
+	}
+	return rv
+}
+
+func (a *accessLog) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: requestID(req)}
+		w.Header().Set("X-Request-ID", info.id)
+
+		ctx := context.WithValue(req.Context(), requestInfoKey{}, info)
+		ctx = withSpanExporter(ctx, a.spans)
+		ctx, span := startSpan(ctx, "http.request")
+		// the request ID may come from the client, so it is only noted,
+		// not used as the trace ID
+		span.set("http.request_id", info.id)
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sw, req.WithContext(ctx))
+
+		info.mutex.Lock()
+		defer info.mutex.Unlock()
+		span.set("http.method", req.Method)
+		span.set("http.route", info.route)
+		span.set("http.status_code", sw.code)
+		span.end(nil)
+
+		if a.logger == nil {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", info.id),
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.String("route", info.route),
+			slog.Int("status", sw.code),
+			slog.Int64("bytes", sw.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			slog.String("client", req.RemoteAddr),
+		}
+		if info.queryType != "" {
+			attrs = append(attrs, slog.String("query_type", info.queryType))
+		}
+		if info.hits != nil {
+			attrs = append(attrs, slog.Uint64("hits", *info.hits))
+		}
+		a.logger.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// statusWriter notes the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if !s.wroteHeader && code >= 200 {
+		s.code = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusWriter) Flush() {
+	s.wroteHeader = true
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// span is a timed operation, written out as a line of JSON when it ends.
+// The fields are those of an OpenTelemetry span, so that spans can be
+// loaded into tracing tools. Spans started from an HTTP request have the
+// request's trace ID and the request span as their parent. A nil *span,
+// from a context without an exporter, records nothing.
+type span struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+
+	exporter *spanExporter
+	mutex    sync.Mutex
+}
+
+// spanExporter writes ended spans as JSON lines.
+type spanExporter struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+func newSpanExporter(w io.Writer) *spanExporter {
+	return &spanExporter{
+		enc: json.NewEncoder(w),
+	}
+}
+
+type spanExporterKey struct{}
+
+type spanKey struct{}
+
+func withSpanExporter(ctx context.Context, exporter *spanExporter) context.Context {
+	if exporter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanExporterKey{}, exporter)
+}
+
+// startSpan starts a span named name, the child of any span in ctx, and
+// returns a context holding it.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	exporter, _ := ctx.Value(spanExporterKey{}).(*spanExporter)
+	if exporter == nil {
+		return ctx, nil
+	}
+	s := &span{
+		SpanID:   newID(8),
+		Name:     name,
+		Start:    time.Now(),
+		exporter: exporter,
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = newID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// set sets an attribute of the span.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+}
+
+// end ends the span, failed if err is not nil, and writes it out.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.End = time.Now()
+	s.DurationMS = float64(s.End.Sub(s.Start)) / float64(time.Millisecond)
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	s.exporter.mutex.Lock()
+	defer s.exporter.mutex.Unlock()
+	s.exporter.enc.Encode(s)
+}
+
+// traced wraps h in a span named name, with the document ID of the
+// request, if it has one.
+func traced(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, span := startSpan(req.Context(), name)
+		if docID := docIDLookup(req); docID != "" {
+			span.set("doc_id", docID)
+		}
+		h.ServeHTTP(w, req.WithContext(ctx))
+		span.end(nil)
+	})
+}
@@ -0,0 +1,111 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/gorilla/mux"
+)
+
+func TestQueryTypeName(t *testing.T) {
+	tests := map[string]query.Query{
+		"query_string":  bleve.NewQueryStringQuery("stout"),
+		"match_phrase":  bleve.NewMatchPhraseQuery("pale ale"),
+		"numeric_range": bleve.NewNumericRangeQuery(nil, nil),
+		"boolean":       bleve.NewBooleanQuery(),
+		"":              nil,
+	}
+	for expected, q := range tests {
+		if name := queryTypeName(q); name != expected {
+			t.Errorf("expected %q, got %q", expected, name)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(noteRoute)
+	router.Handle("/api/things/{docID}", traced("lookup", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, span := startSpan(req.Context(), "inner")
+		span.end(nil)
+		info := requestInfoFrom(req.Context())
+		info.noteQuery(bleve.NewMatchQuery("stout"))
+		info.noteHits(42)
+		mustEncode(w, map[string]string{"status": "ok"})
+	})))
+
+	var logs, spans bytes.Buffer
+	handler := newAccessLog(&logs, newSpanExporter(&spans)).wrap(router)
+
+	req := httptest.NewRequest("GET", "/api/things/x", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if id := rec.Header().Get("X-Request-ID"); id != "req-1" {
+		t.Errorf("expected the request ID back, got %q", id)
+	}
+
+	var entry struct {
+		RequestID string  `json:"request_id"`
+		Route     string  `json:"route"`
+		Status    int     `json:"status"`
+		QueryType string  `json:"query_type"`
+		Hits      uint64  `json:"hits"`
+		LatencyMS float64 `json:"latency_ms"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.RequestID != "req-1" || entry.Route != "/api/things/{docID}" || entry.Status != 200 || entry.QueryType != "match" || entry.Hits != 42 {
+		t.Errorf("unexpected log entry %+v", entry)
+	}
+
+	// spans end innermost first, and share a trace of their own, noting
+	// the request ID
+	var got []*span
+	for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+		s := &span{}
+		if err := json.Unmarshal([]byte(line), s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	if len(got) != 3 || got[0].Name != "inner" || got[1].Name != "lookup" || got[2].Name != "http.request" {
+		t.Fatalf("expected inner, lookup and http.request spans, got %+v", got)
+	}
+	for n, s := range got {
+		if s.TraceID != got[2].TraceID || len(s.TraceID) != 32 || s.TraceID == "req-1" {
+			t.Errorf("expected a new trace for the request, got %s", s.TraceID)
+		}
+		if n < 2 && s.ParentID != got[n+1].SpanID {
+			t.Errorf("expected %s to be a child of %s", s.Name, got[n+1].Name)
+		}
+	}
+	if got[1].Attributes["doc_id"] != "x" || got[2].Attributes["http.request_id"] != "req-1" || got[2].ParentID != "" {
+		t.Errorf("unexpected spans %+v", got)
+	}
+
+	// bad request IDs are replaced
+	req = httptest.NewRequest("GET", "/api/things/x", nil)
+	req.Header.Set("X-Request-ID", "has spaces")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if id := rec.Header().Get("X-Request-ID"); id == "has spaces" || len(id) != 32 {
+		t.Errorf("expected a new request ID, got %q", id)
+	}
+}
@@ -0,0 +1,365 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// queryError is a query that doesn't parse. For query strings, Position
+// is the number of characters before the one where it went wrong.
+type queryError struct {
+	Message  string `json:"message"`
+	Position *int   `json:"position,omitempty"`
+}
+
+// queryTerm is a term searched for, and how many documents have it.
+type queryTerm struct {
+	Term   string `json:"term"`
+	Exists bool   `json:"exists"`
+	Count  uint64 `json:"count"`
+}
+
+// queryNode is one query of the expanded query tree, with the text it
+// searches for as the field's analyzer turns it into terms.
+type queryNode struct {
+	Type         string       `json:"type"`
+	Field        string       `json:"field,omitempty"`
+	Analyzer     string       `json:"analyzer,omitempty"`
+	Text         string       `json:"text,omitempty"`
+	Terms        []queryTerm  `json:"terms,omitempty"`
+	Fuzziness    int          `json:"fuzziness,omitempty"`
+	Min          interface{}  `json:"min,omitempty"`
+	Max          interface{}  `json:"max,omitempty"`
+	InclusiveMin *bool        `json:"inclusive_min,omitempty"`
+	InclusiveMax *bool        `json:"inclusive_max,omitempty"`
+	Must         []*queryNode `json:"must,omitempty"`
+	Should       []*queryNode `json:"should,omitempty"`
+	MustNot      []*queryNode `json:"must_not,omitempty"`
+	Children     []*queryNode `json:"children,omitempty"`
+}
+
+// validateHandler parses a query without running it. The query is a
+// query string, or a bleve query object like the query of a search
+// request. The response says whether it is valid, and if so shows the
+// query tree, the fields searched and whether each term is in the index.
+type validateHandler struct {
+	defaultIndexName string
+}
+
+func newValidateHandler(defaultIndexName string) *validateHandler {
+	return &validateHandler{
+		defaultIndexName: defaultIndexName,
+	}
+}
+
+func (h *validateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	idx := bleveHttp.IndexByName(h.defaultIndexName)
+	if idx == nil {
+		showError(w, req, fmt.Sprintf("no such index '%s'", h.defaultIndexName), 404)
+		return
+	}
+	m := idx.Mapping()
+	if m == nil {
+		showError(w, req, "index has no mapping", 500)
+		return
+	}
+
+	requestBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error reading request body: %v", err), 400)
+		return
+	}
+	var validateRequest struct {
+		Query json.RawMessage `json:"query"`
+	}
+	err = json.Unmarshal(requestBody, &validateRequest)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error parsing request: %v", err), 400)
+		return
+	}
+	if len(validateRequest.Query) == 0 {
+		showError(w, req, "a query is required", 400)
+		return
+	}
+
+	rv := struct {
+		Valid  bool        `json:"valid"`
+		Error  *queryError `json:"error,omitempty"`
+		Query  *queryNode  `json:"query,omitempty"`
+		Fields []string    `json:"fields,omitempty"`
+	}{}
+
+	q, qErr := parseValidateQuery(validateRequest.Query)
+	if qErr != nil {
+		rv.Error = qErr
+		mustEncode(w, rv)
+		return
+	}
+
+	v := &queryValidator{index: idx, mapping: m, fields: map[string]bool{}}
+	rv.Query, err = v.expand(q)
+	if err != nil {
+		showError(w, req, fmt.Sprintf("error checking terms: %v", err), 500)
+		return
+	}
+	rv.Valid = true
+	for field := range v.fields {
+		rv.Fields = append(rv.Fields, field)
+	}
+	sort.Strings(rv.Fields)
+	mustEncode(w, rv)
+}
+
+// parseValidateQuery parses a query string, given as a JSON string, or a
+// query object. Query strings, alone or in an object, have the position
+// of any syntax error found.
+func parseValidateQuery(raw json.RawMessage) (query.Query, *queryError) {
+	var q query.Query
+	var qs string
+	if err := json.Unmarshal(raw, &qs); err == nil {
+		q = query.NewQueryStringQuery(qs)
+	} else {
+		q, err = query.ParseQuery(raw)
+		if err != nil {
+			return nil, &queryError{Message: err.Error()}
+		}
+	}
+
+	if qsq, ok := q.(*query.QueryStringQuery); ok {
+		parsed, err := qsq.Parse()
+		if err != nil {
+			offset := syntaxErrorOffset(qsq.Query)
+			position := utf8.RuneCountInString(qsq.Query[:offset])
+			return nil, &queryError{Message: err.Error(), Position: &position}
+		}
+		q = parsed
+	}
+
+	if vq, ok := q.(query.ValidatableQuery); ok {
+		if err := vq.Validate(); err != nil {
+			return nil, &queryError{Message: err.Error()}
+		}
+	}
+	return q, nil
+}
+
+// syntaxErrorOffset returns the byte offset in the invalid query string
+// qs where it goes wrong. bleve's parser doesn't say, so this is the end
+// of the longest prefix that can still be completed into a valid query,
+// found by binary search since every prefix of a completable prefix is
+// completable.
+func syntaxErrorOffset(qs string) int {
+	var offsets []int
+	for offset := range qs {
+		offsets = append(offsets, offset)
+	}
+	offsets = append(offsets, len(qs))
+
+	// offsets[lo] is completable, and offsets[hi] isn't, or is the end
+	lo, hi := 0, len(offsets)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if completable(qs[:offsets[mid]]) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return offsets[lo]
+}
+
+// completable reports whether prefix is the start of a valid query
+// string, by trying a few likely endings.
+func completable(prefix string) bool {
+	for _, ending := range []string{"", "x", "1", `"`} {
+		if _, err := query.NewQueryStringQuery(prefix + ending).Parse(); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// queryValidator expands queries, noting the fields they search.
+type queryValidator struct {
+	index   bleve.Index
+	mapping mapping.IndexMapping
+	fields  map[string]bool
+}
+
+func (v *queryValidator) field(field string) string {
+	if field == "" {
+		field = v.mapping.DefaultSearchField()
+	}
+	v.fields[field] = true
+	return field
+}
+
+// terms checks whether each term is in field.
+func (v *queryValidator) terms(field string, terms []string) ([]queryTerm, error) {
+	rv := make([]queryTerm, len(terms))
+	for n, term := range terms {
+		count, err := termDocCount(v.index, field, term)
+		if err != nil {
+			return nil, err
+		}
+		rv[n] = queryTerm{Term: term, Exists: count > 0, Count: count}
+	}
+	return rv, nil
+}
+
+// analyze returns the terms the analyzer makes of text, or, if there is
+// no such analyzer, the text as one term.
+func (v *queryValidator) analyze(analyzerName, text string) []string {
+	analyzer := v.mapping.AnalyzerNamed(analyzerName)
+	if analyzer == nil {
+		return []string{text}
+	}
+	var terms []string
+	for _, token := range analyzer.Analyze([]byte(text)) {
+		terms = append(terms, string(token.Term))
+	}
+	return terms
+}
+
+func (v *queryValidator) expandAll(queries []query.Query) ([]*queryNode, error) {
+	var rv []*queryNode
+	for _, q := range queries {
+		node, err := v.expand(q)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, node)
+	}
+	return rv, nil
+}
+
+// clauses returns the queries of a boolean query clause, looking through
+// the conjunction or disjunction that holds them.
+func clauses(q query.Query) []query.Query {
+	switch q := q.(type) {
+	case nil:
+		return nil
+	case *query.ConjunctionQuery:
+		return q.Conjuncts
+	case *query.DisjunctionQuery:
+		return q.Disjuncts
+	}
+	return []query.Query{q}
+}
+
+func (v *queryValidator) expand(q query.Query) (*queryNode, error) {
+	var err error
+	rv := &queryNode{}
+	switch q := q.(type) {
+	case *query.BooleanQuery:
+		rv.Type = "boolean"
+		if rv.Must, err = v.expandAll(clauses(q.Must)); err != nil {
+			return nil, err
+		}
+		if rv.Should, err = v.expandAll(clauses(q.Should)); err != nil {
+			return nil, err
+		}
+		if rv.MustNot, err = v.expandAll(clauses(q.MustNot)); err != nil {
+			return nil, err
+		}
+	case *query.ConjunctionQuery:
+		rv.Type = "conjunction"
+		rv.Children, err = v.expandAll(q.Conjuncts)
+	case *query.DisjunctionQuery:
+		rv.Type = "disjunction"
+		rv.Children, err = v.expandAll(q.Disjuncts)
+	case *query.MatchQuery:
+		rv.Type = "match"
+		rv.Field = v.field(q.FieldVal)
+		rv.Analyzer = q.Analyzer
+		if rv.Analyzer == "" {
+			rv.Analyzer = v.mapping.AnalyzerNameForPath(rv.Field)
+		}
+		rv.Text = q.Match
+		rv.Fuzziness = q.Fuzziness
+		rv.Terms, err = v.terms(rv.Field, v.analyze(rv.Analyzer, q.Match))
+	case *query.MatchPhraseQuery:
+		rv.Type = "match_phrase"
+		rv.Field = v.field(q.FieldVal)
+		rv.Analyzer = q.Analyzer
+		if rv.Analyzer == "" {
+			rv.Analyzer = v.mapping.AnalyzerNameForPath(rv.Field)
+		}
+		rv.Text = q.MatchPhrase
+		rv.Fuzziness = q.Fuzziness
+		rv.Terms, err = v.terms(rv.Field, v.analyze(rv.Analyzer, q.MatchPhrase))
+	case *query.TermQuery:
+		rv.Type = "term"
+		rv.Field = v.field(q.FieldVal)
+		rv.Terms, err = v.terms(rv.Field, []string{q.Term})
+	case *query.FuzzyQuery:
+		rv.Type = "fuzzy"
+		rv.Field = v.field(q.FieldVal)
+		rv.Fuzziness = q.Fuzziness
+		rv.Terms, err = v.terms(rv.Field, []string{q.Term})
+	case *query.PrefixQuery:
+		rv.Type = "prefix"
+		rv.Field = v.field(q.FieldVal)
+		rv.Text = q.Prefix
+	case *query.WildcardQuery:
+		rv.Type = "wildcard"
+		rv.Field = v.field(q.FieldVal)
+		rv.Text = q.Wildcard
+	case *query.RegexpQuery:
+		rv.Type = "regexp"
+		rv.Field = v.field(q.FieldVal)
+		rv.Text = q.Regexp
+	case *query.NumericRangeQuery:
+		rv.Type = "numeric_range"
+		rv.Field = v.field(q.FieldVal)
+		if q.Min != nil {
+			rv.Min = *q.Min
+		}
+		if q.Max != nil {
+			rv.Max = *q.Max
+		}
+		rv.InclusiveMin, rv.InclusiveMax = q.InclusiveMin, q.InclusiveMax
+	case *query.DateRangeQuery:
+		rv.Type = "date_range"
+		rv.Field = v.field(q.FieldVal)
+		if !q.Start.IsZero() {
+			rv.Min = q.Start.Format(time.RFC3339)
+		}
+		if !q.End.IsZero() {
+			rv.Max = q.End.Format(time.RFC3339)
+		}
+		rv.InclusiveMin, rv.InclusiveMax = q.InclusiveStart, q.InclusiveEnd
+	case *query.MatchAllQuery:
+		rv.Type = "match_all"
+	case *query.MatchNoneQuery:
+		rv.Type = "match_none"
+	default:
+		rv.Type = fmt.Sprintf("%T", q)
+		if fq, ok := q.(query.FieldableQuery); ok {
+			rv.Field = v.field(fq.Field())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
@@ -0,0 +1,112 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveHttp "github.com/blevesearch/bleve/v2/http"
+)
+
+func TestSyntaxErrorOffset(t *testing.T) {
+	tests := []struct {
+		query  string
+		offset int
+	}{
+		{"abv:>", 5},
+		{"abv:>strong", 5},
+		{"name:ale^x", 9},
+		{`name:"ale`, 9},
+		{"name:ale~x abv:>5", 9},
+	}
+	for _, test := range tests {
+		if _, qErr := parseValidateQuery(json.RawMessage(`"` + strings.ReplaceAll(test.query, `"`, `\"`) + `"`)); qErr == nil {
+			t.Errorf("%q: expected an error", test.query)
+			continue
+		}
+		if offset := syntaxErrorOffset(test.query); offset != test.offset {
+			t.Errorf("%q: expected offset %d, got %d", test.query, test.offset, offset)
+		}
+	}
+}
+
+func TestValidateHandler(t *testing.T) {
+	mapping, err := buildIndexMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	indexTestBeer(t, index, 100)
+
+	bleveHttp.RegisterIndexName("beer-validate-test", index)
+	defer bleveHttp.UnregisterIndexByName("beer-validate-test")
+	handler := newValidateHandler("beer-validate-test")
+
+	type result struct {
+		Valid  bool        `json:"valid"`
+		Error  *queryError `json:"error"`
+		Query  *queryNode  `json:"query"`
+		Fields []string    `json:"fields"`
+	}
+	validate := func(body string) result {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/validate", strings.NewReader(body)))
+		if rec.Code != 200 {
+			t.Fatalf("%s: expected 200, got %d: %s", body, rec.Code, rec.Body)
+		}
+		var rv result
+		if err := json.Unmarshal(rec.Body.Bytes(), &rv); err != nil {
+			t.Fatal(err)
+		}
+		return rv
+	}
+
+	rv := validate(`{"query": "+name:ales -description:xyzzy abv:>5"}`)
+	if !rv.Valid || rv.Query == nil || rv.Query.Type != "boolean" {
+		t.Fatalf("expected a valid boolean query, got %+v", rv)
+	}
+	if !reflect.DeepEqual(rv.Fields, []string{"abv", "description", "name"}) {
+		t.Errorf("expected fields abv, description and name, got %v", rv.Fields)
+	}
+	must := rv.Query.Must[0]
+	if must.Field != "name" || must.Analyzer != "en" || len(must.Terms) != 1 || must.Terms[0].Term != "al" || !must.Terms[0].Exists {
+		t.Errorf("expected name:ales to search for the existing term al, got %+v", must)
+	}
+	mustNot := rv.Query.MustNot[0]
+	if len(mustNot.Terms) != 1 || mustNot.Terms[0].Exists {
+		t.Errorf("expected xyzzy not to exist, got %+v", mustNot)
+	}
+	if should := rv.Query.Should[0]; should.Type != "numeric_range" || should.Min != 5.0 {
+		t.Errorf("expected a numeric range from 5, got %+v", should)
+	}
+
+	rv = validate(`{"query": {"match": "brewing", "field": "description"}}`)
+	if !rv.Valid || rv.Query.Type != "match" || rv.Query.Terms[0].Term != "brew" {
+		t.Errorf("expected a match query for brew, got %+v", rv.Query)
+	}
+
+	rv = validate(`{"query": "name:ale abv:>strong"}`)
+	if rv.Valid || rv.Error == nil || rv.Error.Position == nil || *rv.Error.Position != 14 {
+		t.Errorf("expected an error at position 14, got %+v", rv.Error)
+	}
+	rv = validate(`{"query": {"bogus": true}}`)
+	if rv.Valid || rv.Error == nil || rv.Error.Position != nil {
+		t.Errorf("expected an error without a position, got %+v", rv.Error)
+	}
+}